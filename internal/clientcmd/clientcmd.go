@@ -0,0 +1,1020 @@
+// Package clientcmd implements the rpc-client command, which calls an rpclab
+// server from the command line with retries, batches, streams and load
+// tests. client.go at the repository root is its main.
+package clientcmd
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yourusername/rpc-go-lab/rpclab"
+)
+
+// give each call a trace id and log its span as JSON
+var tracing bool
+
+// nextRequestID returns the id for each new request: a random UUID unless
+// -request-id or -id-prefix is given
+var nextRequestID = rpclab.NewRequestID
+
+// retry waits: backoffBase doubles per attempt up to backoffMax, plus up to
+// backoffJitter of random delay
+var (
+	backoffBase   = 200 * time.Millisecond
+	backoffMax    = 10 * time.Second
+	backoffJitter = 200 * time.Millisecond
+)
+
+// retryCodes are the server error codes retried like transport failures
+var retryCodes = rpclab.DefaultRetryCodes
+
+// Main runs the rpc-client command with the process arguments
+func Main() {
+	// connection settings; PoolSize, Timeout and Breaker are filled in below
+	cc := rpclab.ClientConfig{Transport: "tcp", Framing: "json", MaxFrameSize: 1 << 20}
+	server := flag.String("server", "", "server address host:port (required)")
+	method := flag.String("method", "add", "method to call (add|subtract|multiply|divide|ping|get_time|reverse_string|transform|hash|slow|crash|sleep_then_crash|sleep_random|echo|countdown|random|ulid|slowest|stats|list_methods|reflect)")
+	params := flag.String("params", "{}", "json string of params, e.g. '{\"a\":5,\"b\":7}'")
+	timeout := flag.Int("timeout", 2, "per-request timeout seconds")
+	maxRetries := flag.Int("retries", 3, "max number of attempts")
+	outputFormat := outputFormatFlags(flag.CommandLine)
+	requestID := flag.String("request-id", "", "use this fixed request id instead of a random one (single call only)")
+	idPrefix := flag.String("id-prefix", "", "number request ids <prefix>-0001, <prefix>-0002, ... instead of random ones")
+	dryRun := flag.Bool("dry-run", false, "print the exact bytes of the request instead of sending it, then exit without connecting")
+	stream := flag.Bool("stream", false, "print every response frame until the server closes the connection, for streaming methods like countdown (no retries)")
+	paramsFromStdin := flag.Bool("params-from-stdin", false, "read the params JSON object from stdin instead of -params")
+	paramsFile := flag.String("params-file", "", "read the params JSON from this file (- for stdin) instead of -params")
+	localAddr := flag.String("dial-local-addr", "", "local source address to dial from, ip or ip:port")
+	assertResult := flag.String("assert-result", "", "expected result as JSON; exit non-zero if the response result differs")
+	flag.BoolVar(&cc.VerifyChecksum, "verify-checksum", false, "verify the server's result checksum and retry on mismatch")
+	oneway := flag.Bool("oneway", false, "fire-and-forget: send the request and don't wait for a response")
+	traceFile := flag.String("trace-file", "", "append a JSON-lines record of each call to this file")
+	flag.DurationVar(&backoffBase, "backoff-base", 200*time.Millisecond, "wait after the first failed attempt; doubles for each further attempt")
+	flag.DurationVar(&backoffMax, "backoff-max", 10*time.Second, "cap on the doubling wait between attempts")
+	flag.DurationVar(&backoffJitter, "jitter", 200*time.Millisecond, "max random delay added to each wait")
+	retryOnStatus := flag.String("retry-on-status", strings.Join(rpclab.DefaultRetryCodes, ","), "comma-separated server error codes to retry with backoff, waiting at least the response's retry_after_ms (empty = retry transport failures only)")
+	flag.StringVar(&cc.AuthToken, "auth-token", "", "token to send with every request, for servers started with -auth-token")
+	flag.BoolVar(&tracing, "trace", false, "send a trace_id/span_id with each call and log client spans as JSON, to correlate with the server's span log")
+	breakerThreshold := flag.Int("breaker-threshold", 0, "fail calls fast after this many consecutive transport failures (0 = no circuit breaker)")
+	breakerCooldown := flag.Duration("breaker-cooldown", 5*time.Second, "how long the circuit breaker stays open before letting one probe call through")
+	flag.BoolVar(&cc.Compress, "compress", false, "gzip requests of 1KiB or more; the server then compresses large replies too (tcp only)")
+	flag.StringVar(&cc.Transport, "transport", cc.Transport, "tcp, or udp for one datagram per call (unreliable: lost packets show up as timeouts; no TLS or framing)")
+	flag.StringVar(&cc.Framing, "framing", cc.Framing, "wire framing: json (bare objects) or length (4-byte big-endian length prefix); must match the server")
+	flag.IntVar(&cc.MaxFrameSize, "max-frame-size", cc.MaxFrameSize, "max size in bytes of a single frame in length framing")
+	useTLS := flag.Bool("tls", false, "connect over TLS")
+	caFile := flag.String("ca", "", "PEM CA bundle used to verify the server certificate with -tls (default: system roots)")
+	list := flag.Bool("list", false, "list the methods the server supports and exit")
+	batch := flag.Bool("batch", false, "treat -params as a JSON array of requests ({\"method\":...,\"params\":...}) sent in one round trip")
+	repeat := flag.Int("repeat", 1, "send the call this many times (new request id each)")
+	concurrency := flag.Int("concurrency", 0, "load test: send the call from this many connections at once (-repeat times each) and print a summary")
+	flag.DurationVar(&cc.PoolConnTTL, "pool-conn-ttl", 0, "close pooled connections this old instead of reusing them (0 = no limit)")
+	flag.BoolVar(&cc.ReconnectOnError, "reconnect-on-error", false, "when a call's connection fails, reconnect and resend it once before counting the attempt as failed")
+	poolSize := flag.Int("pool-size", 1, "max idle connections kept open for reuse between calls (0 = new connection per call)")
+	flag.Parse()
+	retryCodes = splitCodes(*retryOnStatus)
+
+	if cc.Framing != "json" && cc.Framing != "length" {
+		log.Fatalf("invalid -framing %q (want json|length)", cc.Framing)
+	}
+	if cc.Transport != "tcp" && cc.Transport != "udp" {
+		log.Fatalf("invalid -transport %q (want tcp|udp)", cc.Transport)
+	}
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	switch {
+	case explicit["request-id"] && explicit["id-prefix"]:
+		log.Fatalf("-request-id and -id-prefix are mutually exclusive")
+	case explicit["request-id"]:
+		if strings.TrimSpace(*requestID) == "" {
+			log.Fatalf("-request-id must not be empty")
+		}
+		if *batch || *concurrency > 0 || *repeat > 1 {
+			log.Fatalf("-request-id names a single call; it can't be combined with -batch, -concurrency or -repeat")
+		}
+		id := *requestID
+		nextRequestID = func() string { return id }
+	case explicit["id-prefix"]:
+		if strings.TrimSpace(*idPrefix) == "" {
+			log.Fatalf("-id-prefix must not be empty")
+		}
+		nextRequestID = sequentialIDs(*idPrefix)
+	}
+	if *stream && (cc.Transport == "udp" || *batch || *concurrency > 0 || *oneway || *assertResult != "" || *traceFile != "") {
+		log.Fatalf("-stream can't be combined with -transport udp, -batch, -concurrency, -oneway, -assert-result or -trace-file")
+	}
+	if cc.Compress && cc.Transport == "udp" {
+		log.Fatalf("-compress is not supported with -transport udp")
+	}
+	if *repeat < 1 {
+		log.Fatalf("-repeat must be at least 1")
+	}
+
+	switch *outputFormat {
+	case "pretty", "json", "result", "table", "csv":
+	default:
+		log.Fatalf("invalid -output-format %q (want pretty|json|result|table|csv)", *outputFormat)
+	}
+
+	if *server == "" && !*dryRun {
+		fmt.Fprintln(os.Stderr, "server flag is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *server != "" {
+		if err := checkServerAddr(*server); err != nil {
+			log.Fatalf("invalid -server: %v", err)
+		}
+	}
+	if *dryRun && (*list || *concurrency > 0) {
+		log.Fatalf("-dry-run can't be combined with -list or -concurrency")
+	}
+
+	var expected interface{}
+	if *assertResult != "" {
+		if err := rpclab.DecodeJSON([]byte(*assertResult), &expected); err != nil {
+			log.Fatalf("invalid -assert-result json: %v", err)
+		}
+	}
+
+	if *caFile != "" && !*useTLS {
+		log.Fatalf("-ca requires -tls")
+	}
+	if *useTLS && cc.Transport == "udp" {
+		log.Fatalf("-tls is not supported with -transport udp")
+	}
+	if *useTLS {
+		cfg, err := loadTLSConfig(*caFile)
+		if err != nil {
+			log.Fatalf("tls: %v", err)
+		}
+		cc.TLS = cfg
+	}
+
+	if *localAddr != "" {
+		a, err := parseLocalAddr(*localAddr)
+		if err != nil {
+			log.Fatalf("invalid -dial-local-addr: %v", err)
+		}
+		cc.LocalAddr = a
+	}
+
+	paramsJSON, err := readParams(os.Stdin, *params, flagWasSet("params"), *paramsFromStdin, *paramsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *poolSize < 0 {
+		log.Fatalf("-pool-size must not be negative")
+	}
+	cc.Timeout = time.Duration(*timeout) * time.Second
+	cc.PoolSize = *poolSize
+	cc.NewRequestID = nextRequestID
+	// -concurrency workers share this breaker, so a dead server trips it once for the run
+	cc.Breaker = rpclab.NewBreaker(*breakerThreshold, *breakerCooldown)
+	c := rpclab.NewClient(*server, cc)
+	defer c.Close()
+
+	if *list {
+		resp, err := c.Call("list_methods", map[string]interface{}{})
+		if err != nil {
+			log.Fatalf("list_methods: %v", err)
+		}
+		if err := printMethodList(os.Stdout, resp.Result); err != nil {
+			log.Fatalf("list_methods: %v", err)
+		}
+		return
+	}
+
+	if *batch {
+		if *outputFormat == "table" || *outputFormat == "csv" || *assertResult != "" || *traceFile != "" || *oneway {
+			log.Fatalf("-batch only supports -output-format pretty|json|result and can't be combined with -assert-result, -trace-file or -oneway")
+		}
+		var reqs []rpclab.Request
+		if err := rpclab.DecodeJSON(paramsJSON, &reqs); err != nil {
+			log.Fatalf("invalid batch json: %v", err)
+		}
+		if len(reqs) == 0 {
+			log.Fatalf("invalid batch json: expected a non-empty array of requests")
+		}
+		for i := 0; i < *repeat; i++ {
+			for j := range reqs {
+				reqs[j].RequestID = nextRequestID()
+				if reqs[j].Method == "" {
+					reqs[j].Method = *method
+				}
+				reqs[j].Timestamp = time.Now().Format(time.RFC3339)
+			}
+			if *dryRun {
+				if tracing {
+					traceBatch(reqs)
+				}
+				wire := make([]rpclab.Request, len(reqs))
+				for j := range reqs {
+					reqs[j].Attempt = 1
+					wire[j] = *withAuth(&reqs[j], cc.AuthToken)
+				}
+				if err := printDryRun(os.Stdout, wire, cc); err != nil {
+					log.Fatalf("dry run: %v", err)
+				}
+				return
+			}
+			if code := runBatch(c, *maxRetries, reqs, *outputFormat); code != 0 {
+				c.Close()
+				os.Exit(code)
+			}
+		}
+		return
+	}
+
+	var paramMap map[string]interface{}
+	if err := rpclab.DecodeJSON(paramsJSON, &paramMap); err != nil {
+		log.Fatalf("invalid params json: %v", err)
+	}
+	if paramMap == nil {
+		log.Fatalf("invalid params json: expected an object")
+	}
+
+	if *concurrency > 0 {
+		if *oneway || *assertResult != "" || *traceFile != "" {
+			log.Fatalf("-concurrency can't be combined with -oneway, -assert-result or -trace-file")
+		}
+		sum := runLoad(*server, cc, *concurrency, *repeat, *method, paramMap)
+		sum.print(os.Stdout)
+		if sum.failed > 0 {
+			c.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *dryRun {
+		req := rpclab.Request{
+			RequestID: nextRequestID(),
+			Method:    *method,
+			Params:    paramMap,
+			Timestamp: time.Now().Format(time.RFC3339),
+			Oneway:    *oneway,
+			Attempt:   1,
+		}
+		if tracing {
+			req.TraceID, req.SpanID = newTraceIDs()
+		}
+		if err := printDryRun(os.Stdout, withAuth(&req, cc.AuthToken), cc); err != nil {
+			log.Fatalf("dry run: %v", err)
+		}
+		return
+	}
+
+	if *stream {
+		for i := 0; i < *repeat; i++ {
+			req := rpclab.Request{
+				RequestID: nextRequestID(),
+				Method:    *method,
+				Params:    paramMap,
+				Timestamp: time.Now().Format(time.RFC3339),
+				Attempt:   1,
+			}
+			if code := runStream(c, &req, *outputFormat); code != 0 {
+				c.Close()
+				os.Exit(code)
+			}
+		}
+		return
+	}
+
+	opts := &callOptions{
+		server:       *server,
+		maxRetries:   *maxRetries,
+		outputFormat: *outputFormat,
+		traceFile:    *traceFile,
+		assert:       *assertResult != "",
+		expected:     expected,
+	}
+	for i := 0; i < *repeat; i++ {
+		req := rpclab.Request{
+			RequestID: nextRequestID(),
+			Method:    *method,
+			Params:    paramMap,
+			Timestamp: time.Now().Format(time.RFC3339),
+			Oneway:    *oneway,
+		}
+		if code := runCall(c, opts, &req); code != 0 {
+			c.Close()
+			os.Exit(code)
+		}
+	}
+}
+
+// runStream sends req once and prints each response frame as it arrives,
+// returning the process exit code
+func runStream(c *rpclab.Client, req *rpclab.Request, format string) int {
+	log.Printf("Streaming request %s", req.RequestID)
+	if tracing {
+		req.TraceID, req.SpanID = newTraceIDs()
+	}
+	start := time.Now()
+	frames := 0
+	err := c.Stream(req, func(resp *rpclab.Response) error {
+		frames++
+		return printResponse(os.Stdout, resp, format)
+	})
+	if tracing {
+		logSpan(req, start, err)
+	}
+	if err != nil {
+		log.Printf("Stream failed after %d frames: %v", frames, err)
+		return 1
+	}
+	log.Printf("Stream ended after %d frames", frames)
+	return 0
+}
+
+// loadSummary aggregates the outcome of a -concurrency run
+type loadSummary struct {
+	mu       sync.Mutex
+	ok       int
+	failed   int
+	errors   map[string]int
+	min, max time.Duration
+	total    time.Duration
+	elapsed  time.Duration
+}
+
+func (s *loadSummary) add(d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.failed++
+		s.errors[err.Error()]++
+		return
+	}
+	if s.ok == 0 || d < s.min {
+		s.min = d
+	}
+	if d > s.max {
+		s.max = d
+	}
+	s.ok++
+	s.total += d
+}
+
+func (s *loadSummary) print(w io.Writer) {
+	n := s.ok + s.failed
+	fmt.Fprintf(w, "Requests: %d  OK: %d  Failed: %d  in %v", n, s.ok, s.failed, s.elapsed.Round(time.Millisecond))
+	if s.elapsed > 0 {
+		fmt.Fprintf(w, " (%.1f req/s)", float64(n)/s.elapsed.Seconds())
+	}
+	fmt.Fprintln(w)
+	if s.ok > 0 {
+		avg := s.total / time.Duration(s.ok)
+		fmt.Fprintf(w, "Latency (OK only): min %.3fms  avg %.3fms  max %.3fms\n", durMs(s.min), durMs(avg), durMs(s.max))
+	}
+	msgs := make([]string, 0, len(s.errors))
+	for m := range s.errors {
+		msgs = append(msgs, m)
+	}
+	sort.Strings(msgs)
+	for _, m := range msgs {
+		fmt.Fprintf(w, "  %dx %s\n", s.errors[m], m)
+	}
+}
+
+// runLoad sends `repeat` calls from each of `workers` goroutines, each on its
+// own connection and with a fresh request id per call. Calls are not retried
+// so failures and latencies are reported as they happened.
+func runLoad(server string, cc rpclab.ClientConfig, workers, repeat int, method string, params map[string]interface{}) *loadSummary {
+	sum := &loadSummary{errors: map[string]int{}}
+	log.Printf("Sending %d x %d %s calls", workers, repeat, method)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wc := cc
+			wc.PoolSize = 1
+			c := rpclab.NewClient(server, wc)
+			defer c.Close()
+			for j := 0; j < repeat; j++ {
+				req := &rpclab.Request{
+					RequestID: nextRequestID(),
+					Method:    method,
+					Params:    params,
+					Timestamp: time.Now().Format(time.RFC3339),
+					Attempt:   1,
+				}
+				t := time.Now()
+				_, err := c.Do(req)
+				sum.add(time.Since(t), err)
+			}
+		}()
+	}
+	wg.Wait()
+	sum.elapsed = time.Since(start)
+	return sum
+}
+
+// runBatch sends a batch, retrying the whole batch only on transport
+// failures, and prints the responses. Elements that failed on the server are
+// reported in the output rather than retried; any of them makes the exit code 1.
+func runBatch(c *rpclab.Client, maxRetries int, reqs []rpclab.Request, format string) int {
+	if tracing {
+		traceBatch(reqs)
+	}
+	var lastErr error
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		log.Printf("Attempt %d/%d for batch of %d requests", attempt, maxRetries, len(reqs))
+		for i := range reqs {
+			reqs[i].Attempt = attempt
+		}
+		resps, err := c.DoBatch(reqs)
+		if err == nil {
+			if resps == nil {
+				log.Printf("Sent batch of oneway requests")
+				return 0
+			}
+			if err := printBatch(os.Stdout, resps, format); err != nil {
+				log.Printf("print responses: %v", err)
+				return 1
+			}
+			for _, r := range resps {
+				if r.Status != "OK" {
+					return 1
+				}
+			}
+			return 0
+		}
+		lastErr = err
+		log.Printf("Attempt %d error: %v", attempt, err)
+		if !rpclab.RetryableOn(err, retryCodes) {
+			log.Printf("Not retrying: %s", noRetryReason(err))
+			break
+		}
+		time.Sleep(retryWait(attempt, err))
+	}
+	log.Printf("All attempts failed. last error: %v", lastErr)
+	return 1
+}
+
+// callOptions holds the CLI settings that shape how a call is retried and reported
+type callOptions struct {
+	server       string
+	maxRetries   int
+	outputFormat string
+	traceFile    string
+	assert       bool
+	expected     interface{}
+}
+
+// runCall sends req with retries, prints the outcome and returns the process
+// exit code: 0 on success, 1 if every attempt failed, 2 on an assert mismatch
+func runCall(c *rpclab.Client, opts *callOptions, req *rpclab.Request) int {
+	reqID := req.RequestID
+	if tracing {
+		req.TraceID, req.SpanID = newTraceIDs()
+	}
+	trace := &traceEntry{
+		Started: time.Now().Format(time.RFC3339Nano),
+		Server:  opts.server,
+		Request: req,
+	}
+	traceStart := time.Now()
+	// finish records the outcome of the call in the trace file, if enabled
+	finish := func(resp *rpclab.Response, err error) {
+		if tracing {
+			logSpan(req, traceStart, err)
+		}
+		if opts.traceFile == "" {
+			return
+		}
+		trace.Response = resp
+		trace.DurationMs = msSince(traceStart)
+		switch {
+		case resp != nil:
+			trace.Status = resp.Status
+		case err == nil:
+			// oneway request: delivered, no response expected
+			trace.Status = "SENT"
+		default:
+			trace.Status = "FAILED"
+		}
+		if err != nil {
+			trace.Error = err.Error()
+		}
+		if werr := appendTrace(opts.traceFile, trace); werr != nil {
+			log.Printf("trace file: %v", werr)
+		}
+	}
+
+	var lastErr error
+	var lastResp *rpclab.Response
+	for attempt := 1; attempt <= opts.maxRetries; attempt++ {
+		log.Printf("Attempt %d/%d for request %s", attempt, opts.maxRetries, reqID)
+		req.Attempt = attempt
+		attemptStart := time.Now()
+		resp, err := c.Do(req)
+		trace.Attempts = attempt
+		ta := traceAttempt{Attempt: attempt, DurationMs: msSince(attemptStart)}
+		if err != nil {
+			ta.Error = err.Error()
+		}
+		trace.AttemptLog = append(trace.AttemptLog, ta)
+		if err == nil && req.Oneway {
+			finish(nil, nil)
+			log.Printf("Sent oneway request %s", reqID)
+			return 0
+		}
+		if err == nil {
+			// success
+			finish(resp, nil)
+			if resp.DurationMs > 0 {
+				log.Printf("Server time %.3f ms of %.3f ms round trip", resp.DurationMs, ta.DurationMs)
+			}
+			if err := printResponse(os.Stdout, resp, opts.outputFormat); err != nil {
+				log.Printf("print response: %v", err)
+				return 1
+			}
+			if opts.assert {
+				if diff := resultDiff(opts.expected, resp.Result); diff != "" {
+					fmt.Fprintln(os.Stderr, diff)
+					return 2
+				}
+				log.Printf("Result matches -assert-result")
+			}
+			return 0
+		}
+		lastErr = err
+		lastResp = resp
+		log.Printf("Attempt %d error: %v", attempt, err)
+		if !rpclab.RetryableOn(err, retryCodes) {
+			log.Printf("Not retrying: %s", noRetryReason(err))
+			break
+		}
+		time.Sleep(retryWait(attempt, err))
+	}
+	finish(lastResp, lastErr)
+	log.Printf("All attempts failed. last error: %v", lastErr)
+	return 1
+}
+
+// span is one timed operation, logged as a JSON line by -trace. The fields
+// follow OpenTelemetry's span model so the client's and server's span logs
+// can be joined on trace_id.
+type span struct {
+	TraceID      string  `json:"trace_id"`
+	SpanID       string  `json:"span_id"`
+	ParentSpanID string  `json:"parent_span_id,omitempty"`
+	Name         string  `json:"name"`
+	RequestID    string  `json:"request_id"`
+	Start        string  `json:"start"`
+	End          string  `json:"end"`
+	DurationMs   float64 `json:"duration_ms"`
+	Status       string  `json:"status"` // "OK" or "ERROR"
+	Error        string  `json:"error,omitempty"`
+}
+
+// logSpan logs the client span of req, which started at start and ended now
+func logSpan(req *rpclab.Request, start time.Time, err error) {
+	end := time.Now()
+	s := span{
+		TraceID:    req.TraceID,
+		SpanID:     req.SpanID,
+		Name:       "rpc.client/" + req.Method,
+		RequestID:  req.RequestID,
+		Start:      start.Format(time.RFC3339Nano),
+		End:        end.Format(time.RFC3339Nano),
+		DurationMs: durMs(end.Sub(start)),
+		Status:     "OK",
+	}
+	if err != nil {
+		s.Status, s.Error = "ERROR", err.Error()
+	}
+	b, _ := json.Marshal(s)
+	log.Printf("span %s", b)
+}
+
+// traceBatch puts a batch in one trace; the server logs a span per element
+func traceBatch(reqs []rpclab.Request) {
+	traceID, spanID := newTraceIDs()
+	for i := range reqs {
+		reqs[i].TraceID, reqs[i].SpanID = traceID, spanID
+	}
+}
+
+// newTraceIDs returns a 32-hex-digit trace id and a 16-digit span id, the
+// W3C trace context sizes, taken from random UUIDs
+func newTraceIDs() (traceID, spanID string) {
+	traceID = strings.ReplaceAll(rpclab.NewRequestID(), "-", "")
+	spanID = strings.ReplaceAll(rpclab.NewRequestID(), "-", "")[:16]
+	return traceID, spanID
+}
+
+// resultDiff compares the decoded result against the expected value and
+// returns a human-readable description of the mismatch, or "" if equal
+func resultDiff(expected, got interface{}) string {
+	if reflect.DeepEqual(expected, got) {
+		return ""
+	}
+	e, _ := json.Marshal(expected)
+	g, _ := json.Marshal(got)
+	return fmt.Sprintf("assert-result failed:\n  expected: %s\n  got:      %s", e, g)
+}
+
+// loadTLSConfig builds the client TLS config, trusting only caFile when given
+func loadTLSConfig(caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}
+
+// parseLocalAddr accepts a bare ip (any source port) or ip:port
+func parseLocalAddr(s string) (*net.TCPAddr, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+	return net.ResolveTCPAddr("tcp", s)
+}
+
+// outputFormatFlags registers -output-format on fs, along with -output, the
+// older spelling scripts may still pass, and returns the value both set
+func outputFormatFlags(fs *flag.FlagSet) *string {
+	format := fs.String("output-format", "pretty", "what to write to stdout: pretty (indented response with a header), json (the response on one line), result (only the result, as JSON), table or csv (the result as rows)")
+	fs.StringVar(format, "output", "pretty", "deprecated alias for -output-format")
+	return format
+}
+
+// checkServerAddr validates a host:port -server value, explaining the
+// common mistakes: a missing port and an unbracketed IPv6 address
+func checkServerAddr(s string) error {
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil && ip.To4() == nil {
+			return fmt.Errorf("%q: IPv6 addresses need brackets and a port, e.g. [%s]:6000", s, ip)
+		}
+		if !strings.Contains(s, ":") {
+			return fmt.Errorf("%q: missing port, e.g. %s:6000", s, s)
+		}
+		return fmt.Errorf("%q: %v", s, err)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("%q: invalid port %q", s, port)
+	}
+	return nil
+}
+
+// flagWasSet reports whether the named flag was given on the command line
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// traceEntry is one call (all of its attempts) in the -trace-file log
+type traceEntry struct {
+	Started    string           `json:"started"`
+	Server     string           `json:"server"`
+	Request    *rpclab.Request  `json:"request"`
+	Response   *rpclab.Response `json:"response,omitempty"`
+	Status     string           `json:"status"` // final response status, "SENT" for oneway, or "FAILED"
+	Error      string           `json:"error,omitempty"`
+	Attempts   int              `json:"attempts"`
+	DurationMs float64          `json:"duration_ms"`
+	AttemptLog []traceAttempt   `json:"attempt_log"`
+}
+
+type traceAttempt struct {
+	Attempt    int     `json:"attempt"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// appendTrace appends entry as a single JSON line to path
+func appendTrace(path string, entry *traceEntry) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(entry); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func msSince(t time.Time) float64 {
+	return durMs(time.Since(t))
+}
+
+func durMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// noRetryReason explains a failure rpclab.RetryableOn turned down, for the log
+func noRetryReason(err error) string {
+	if errors.Is(err, rpclab.ErrCircuitOpen) {
+		return "the circuit breaker is open"
+	}
+	var se *rpclab.ServerError
+	if errors.As(err, &se) && se.Code != "" {
+		return fmt.Sprintf("the server rejected the request with code %s, which is not in -retry-on-status", se.Code)
+	}
+	return "the server rejected the request"
+}
+
+// splitCodes parses a comma-separated, case-insensitive list of error codes
+func splitCodes(list string) []string {
+	var out []string
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.ToLower(strings.TrimSpace(c)); c != "" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// retryWait is the pause before the next attempt: the backoff, or longer if
+// the server asked for it with retry_after_ms
+func retryWait(attempt int, err error) time.Duration {
+	wait := computeBackoff(attempt, backoffBase, backoffMax, backoffJitter)
+	if after := rpclab.RetryAfter(err); after > wait {
+		log.Printf("Server asked to retry after %v", after)
+		return after
+	}
+	return wait
+}
+
+// withAuth returns req with token set as its auth_token, leaving the caller's
+// copy (and so the trace file) without it
+func withAuth(req *rpclab.Request, token string) *rpclab.Request {
+	if token == "" {
+		return req
+	}
+	r := *req
+	r.AuthToken = token
+	return &r
+}
+
+// printDryRun writes the bytes v would go on the wire as for -dry-run. In
+// length framing the 4-byte length prefix is shown in hex on its own line,
+// ahead of the payload.
+func printDryRun(w io.Writer, v interface{}, cc rpclab.ClientConfig) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if cc.Compress && len(b) >= rpclab.CompressThreshold {
+		log.Printf("Note: -compress would send these %d bytes gzip-compressed; shown uncompressed", len(b))
+	}
+	if cc.Framing == "length" && cc.Transport != "udp" {
+		var prefix [4]byte
+		binary.BigEndian.PutUint32(prefix[:], uint32(len(b)))
+		if _, err := fmt.Fprintf(w, "length prefix: %x (%d bytes)\n", prefix, len(b)); err != nil {
+			return err
+		}
+	}
+	// json framing sends the newline too; otherwise it just ends the line
+	b = append(b, '\n')
+	_, err = w.Write(b)
+	return err
+}
+
+// readParams returns the params JSON from -params (inline, set says whether
+// it was given), -params-from-stdin or -params-file, at most one of them
+func readParams(stdin io.Reader, inline string, set, fromStdin bool, file string) ([]byte, error) {
+	switch {
+	case fromStdin && set:
+		return nil, errors.New("-params and -params-from-stdin are mutually exclusive")
+	case file != "" && (set || fromStdin):
+		return nil, errors.New("-params-file can't be combined with -params or -params-from-stdin")
+	case fromStdin:
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("read params from stdin: %v", err)
+		}
+		return b, nil
+	case file != "":
+		b, err := readParamsFile(stdin, file)
+		if err != nil {
+			return nil, fmt.Errorf("read -params-file: %v", err)
+		}
+		return b, nil
+	}
+	return []byte(inline), nil
+}
+
+// readParamsFile returns the contents of path, or of stdin for "-"
+func readParamsFile(stdin io.Reader, path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// printResponse writes resp to w in the -output-format: indented with a
+// header, the whole response or only its result as compact JSON, or the
+// result as table or CSV rows
+func printResponse(w io.Writer, resp *rpclab.Response, format string) error {
+	switch format {
+	case "json":
+		return writeJSONLine(w, resp)
+	case "result":
+		return writeJSONLine(w, resp.Result)
+	case "pretty":
+		j, _ := json.MarshalIndent(resp, "", "  ")
+		_, err := fmt.Fprintf(w, "Response:\n%s\n", string(j))
+		return err
+	}
+
+	rows := resultRows(resp.Result)
+	if format == "csv" {
+		cw := csv.NewWriter(w)
+		if err := cw.WriteAll(rows); err != nil {
+			return err
+		}
+		return cw.Error()
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// printBatch writes batch responses to w as printResponse does for one
+func printBatch(w io.Writer, resps []rpclab.Response, format string) error {
+	switch format {
+	case "json":
+		return writeJSONLine(w, resps)
+	case "result":
+		results := make([]interface{}, len(resps))
+		for i, r := range resps {
+			results[i] = r.Result
+		}
+		return writeJSONLine(w, results)
+	}
+	j, _ := json.MarshalIndent(resps, "", "  ")
+	_, err := fmt.Fprintf(w, "Responses:\n%s\n", string(j))
+	return err
+}
+
+// writeJSONLine writes v to w as one line of compact JSON
+func writeJSONLine(w io.Writer, v interface{}) error {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", j)
+	return err
+}
+
+// printMethodList renders a list_methods result as a NAME/DESCRIPTION table
+func printMethodList(w io.Writer, result interface{}) error {
+	methods, ok := result.([]interface{})
+	if !ok {
+		return fmt.Errorf("unexpected result %T", result)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tDESCRIPTION")
+	for _, m := range methods {
+		obj, _ := m.(map[string]interface{})
+		fmt.Fprintf(tw, "%s\t%s\n", cellString(obj["name"]), cellString(obj["desc"]))
+	}
+	return tw.Flush()
+}
+
+// resultRows flattens a decoded JSON result into a header row plus data rows:
+// objects become key/value rows, arrays of objects become one row per element
+// with the union of keys as columns, anything else becomes a single value column.
+func resultRows(result interface{}) [][]string {
+	switch t := result.(type) {
+	case map[string]interface{}:
+		rows := [][]string{{"key", "value"}}
+		for _, k := range sortedKeys(t) {
+			rows = append(rows, []string{k, cellString(t[k])})
+		}
+		return rows
+	case []interface{}:
+		objects := true
+		colSet := map[string]interface{}{}
+		for _, e := range t {
+			m, ok := e.(map[string]interface{})
+			if !ok {
+				objects = false
+				break
+			}
+			for k := range m {
+				colSet[k] = nil
+			}
+		}
+		if !objects || len(t) == 0 {
+			rows := [][]string{{"value"}}
+			for _, e := range t {
+				rows = append(rows, []string{cellString(e)})
+			}
+			return rows
+		}
+		cols := sortedKeys(colSet)
+		rows := [][]string{cols}
+		for _, e := range t {
+			m := e.(map[string]interface{})
+			row := make([]string, len(cols))
+			for i, c := range cols {
+				if v, ok := m[c]; ok {
+					row[i] = cellString(v)
+				}
+			}
+			rows = append(rows, row)
+		}
+		return rows
+	default:
+		return [][]string{{"value"}, {cellString(t)}}
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// cellString renders a single value; nested structures stay as compact JSON
+func cellString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case map[string]interface{}, []interface{}:
+		j, _ := json.Marshal(t)
+		return string(j)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// sequentialIDs returns a generator of prefix-0001, prefix-0002, ...; it is
+// safe for the concurrent workers of -concurrency
+func sequentialIDs(prefix string) func() string {
+	var n atomic.Int64
+	return func() string { return fmt.Sprintf("%s-%04d", prefix, n.Add(1)) }
+}
+
+// computeBackoff returns the wait after a failed attempt (1-based): base
+// doubled per attempt and capped at max, plus up to jitter of random delay
+func computeBackoff(attempt int, base, max, jitter time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d + randDuration(jitter)
+}
+
+// randDuration returns a random duration in [0, max)
+func randDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return time.Duration(binary.BigEndian.Uint64(b[:]) % uint64(max))
+}
@@ -0,0 +1,590 @@
+package clientcmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yourusername/rpc-go-lab/rpclab"
+)
+
+func TestMain(m *testing.M) {
+	// both the client and the test server log every call
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// startServer serves a default rpclab server, adjusted by configure, on a
+// loopback port until the test ends and returns its address
+func startServer(t *testing.T, configure func(*rpclab.Config)) string {
+	t.Helper()
+	cfg := rpclab.DefaultConfig()
+	cfg.ShutdownTimeout = time.Second
+	if configure != nil {
+		configure(&cfg)
+	}
+	s, err := rpclab.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+	t.Cleanup(func() {
+		s.Shutdown()
+		<-done
+	})
+	return ln.Addr().String()
+}
+
+// closedAddr returns a loopback address nothing is listening on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// fastBackoff shortens the retry waits until the test ends
+func fastBackoff(t *testing.T) {
+	base, max, jitter := backoffBase, backoffMax, backoffJitter
+	backoffBase, backoffMax, backoffJitter = time.Millisecond, time.Millisecond, 0
+	t.Cleanup(func() { backoffBase, backoffMax, backoffJitter = base, max, jitter })
+}
+
+// decodeResult decodes s the way the client sees a result off the wire
+func decodeResult(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := rpclab.DecodeJSON([]byte(s), &v); err != nil {
+		t.Fatalf("decode %s: %v", s, err)
+	}
+	return v
+}
+
+func TestPrintResponseRows(t *testing.T) {
+	tests := []struct {
+		name   string
+		result string
+		format string
+		want   string
+	}{
+		{"map as table", `{"uptime":5,"name":"lab"}`, "table",
+			"key     value\nname    lab\nuptime  5\n"},
+		{"map as csv", `{"uptime":5,"name":"lab"}`, "csv",
+			"key,value\nname,lab\nuptime,5\n"},
+		{"nested values stay json", `{"m":{"a":1},"l":[1,2]}`, "csv",
+			"key,value\nl,\"[1,2]\"\nm,\"{\"\"a\"\":1}\"\n"},
+		{"objects as columns", `[{"a":1,"b":2},{"b":3,"c":"x"}]`, "table",
+			"a  b  c\n1  2  \n   3  x\n"},
+		{"array of scalars", `[3,"x"]`, "csv",
+			"value\n3\nx\n"},
+		{"scalar", `"pong"`, "table",
+			"value\npong\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			resp := &rpclab.Response{RequestID: "1", Status: "OK", Result: decodeResult(t, tt.result)}
+			if err := printResponse(&b, resp, tt.format); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintResponseJSON(t *testing.T) {
+	resp := &rpclab.Response{RequestID: "1", Status: "OK", Result: json.Number("3")}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"json", `{"request_id":"1","result":3,"status":"OK"}` + "\n"},
+		{"result", "3\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := printResponse(&b, resp, tt.format); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.want {
+				t.Errorf("got %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestTraceFile(t *testing.T) {
+	fastBackoff(t)
+	addr := startServer(t, nil)
+	down := closedAddr(t)
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	tests := []struct {
+		server   string
+		method   string
+		params   map[string]interface{}
+		retries  int
+		status   string
+		attempts int
+	}{
+		{addr, "add", map[string]interface{}{"a": 1, "b": 2}, 3, "OK", 1},
+		{addr, "divide", map[string]interface{}{"a": 1, "b": 0}, 3, "ERROR", 1},
+		{down, "ping", nil, 2, "FAILED", 2},
+	}
+	for _, tt := range tests {
+		c := rpclab.NewClient(tt.server, rpclab.ClientConfig{Timeout: 5 * time.Second})
+		opts := &callOptions{server: tt.server, maxRetries: tt.retries, outputFormat: "json", traceFile: path}
+		runCall(c, opts, &rpclab.Request{RequestID: tt.method, Method: tt.method, Params: tt.params})
+		c.Close()
+	}
+
+	entries := readTrace(t, path)
+	if len(entries) != len(tests) {
+		t.Fatalf("got %d trace entries, want %d", len(entries), len(tests))
+	}
+	for i, tt := range tests {
+		e := entries[i]
+		if e.Request == nil || e.Request.Method != tt.method {
+			t.Errorf("entry %d: request %+v, want method %s", i, e.Request, tt.method)
+		}
+		if e.Status != tt.status || e.Attempts != tt.attempts || len(e.AttemptLog) != tt.attempts {
+			t.Errorf("entry %d (%s): status %s after %d attempts (%d logged), want %s after %d",
+				i, tt.method, e.Status, e.Attempts, len(e.AttemptLog), tt.status, tt.attempts)
+		}
+		if (e.Response != nil) != (tt.status != "FAILED") {
+			t.Errorf("entry %d: response %+v", i, e.Response)
+		}
+	}
+}
+
+func TestAssertResult(t *testing.T) {
+	addr := startServer(t, nil)
+	tests := []struct {
+		name     string
+		expected string
+		code     int
+	}{
+		{"match", `5`, 0},
+		{"mismatch", `6`, 2},
+		{"wrong type", `"5"`, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := rpclab.NewClient(addr, rpclab.ClientConfig{Timeout: 5 * time.Second})
+			defer c.Close()
+			opts := &callOptions{server: addr, maxRetries: 1, outputFormat: "json", assert: true, expected: decodeResult(t, tt.expected)}
+			code := runCall(c, opts, &rpclab.Request{RequestID: "r1", Method: "add", Params: map[string]interface{}{"a": 2, "b": 3}})
+			if code != tt.code {
+				t.Errorf("exit code = %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestResultDiff(t *testing.T) {
+	tests := []struct {
+		expected string
+		got      string
+		want     string // "" for a match
+	}{
+		{`{"a":[1,2]}`, `{"a":[1,2]}`, ""},
+		{`{"a":[1,2]}`, `{"a":[2,1]}`, "assert-result failed:\n  expected: {\"a\":[1,2]}\n  got:      {\"a\":[2,1]}"},
+		{`5`, `5.0`, "assert-result failed:\n  expected: 5\n  got:      5.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expected+" vs "+tt.got, func(t *testing.T) {
+			if diff := resultDiff(decodeResult(t, tt.expected), decodeResult(t, tt.got)); diff != tt.want {
+				t.Errorf("diff = %q, want %q", diff, tt.want)
+			}
+		})
+	}
+}
+
+// readTrace returns the entries of a -trace-file
+func readTrace(t *testing.T, path string) []traceEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []traceEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e traceEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("bad trace line %s: %v", sc.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	fastBackoff(t)
+	tests := []struct {
+		name     string
+		codes    string
+		status   string
+		attempts int // exact, or the minimum when the call succeeds
+	}{
+		{"rate_limited retried", "rate_limited", "OK", 2},
+		{"upper case accepted", "RATE_LIMITED,unavailable", "OK", 2},
+		{"not listed", "unavailable", "ERROR", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := retryCodes
+			retryCodes = splitCodes(tt.codes)
+			defer func() { retryCodes = saved }()
+			// one token, back after 200ms; the first call below takes it
+			addr := startServer(t, func(cfg *rpclab.Config) { cfg.Rate, cfg.Burst = 5, 1 })
+			c := rpclab.NewClient(addr, rpclab.ClientConfig{Timeout: 5 * time.Second, PoolSize: 1})
+			defer c.Close()
+			if _, err := c.Call("ping", nil); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(t.TempDir(), "trace.jsonl")
+			opts := &callOptions{server: addr, maxRetries: 5, outputFormat: "json", traceFile: path}
+			start := time.Now()
+			code := runCall(c, opts, &rpclab.Request{RequestID: "r1", Method: "add", Params: map[string]interface{}{"a": 1, "b": 2}})
+			took := time.Since(start)
+			entries := readTrace(t, path)
+			if len(entries) != 1 {
+				t.Fatalf("got %d trace entries, want 1", len(entries))
+			}
+			e := entries[0]
+			if e.Status != tt.status {
+				t.Fatalf("status = %s (%s), want %s", e.Status, e.Error, tt.status)
+			}
+			if tt.status != "OK" {
+				if e.Attempts != tt.attempts || code != 1 {
+					t.Errorf("exit %d after %d attempts, want 1 after %d", code, e.Attempts, tt.attempts)
+				}
+				return
+			}
+			if code != 0 || e.Attempts < tt.attempts {
+				t.Errorf("exit %d after %d attempts, want 0 after at least %d", code, e.Attempts, tt.attempts)
+			}
+			// the backoff is 1ms, so only the retry_after_ms hint explains the wait
+			if took < 150*time.Millisecond {
+				t.Errorf("succeeded after %s, before the server's retry_after_ms", took)
+			}
+		})
+	}
+}
+
+// errorOnceServer answers the first request it reads with an ERROR carrying
+// code and every later one with OK, and counts the requests
+func errorOnceServer(t *testing.T, code string) (string, *atomic.Int64) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	seen := &atomic.Int64{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				dec, enc := json.NewDecoder(conn), json.NewEncoder(conn)
+				for {
+					var req rpclab.Request
+					if err := dec.Decode(&req); err != nil {
+						return
+					}
+					resp := &rpclab.Response{RequestID: req.RequestID, Status: "OK", Result: "pong"}
+					if seen.Add(1) == 1 {
+						resp = &rpclab.Response{RequestID: req.RequestID, Status: "ERROR", Error: "no", Code: code}
+					}
+					enc.Encode(resp)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), seen
+}
+
+func TestApplicationErrorNotRetried(t *testing.T) {
+	fastBackoff(t)
+	tests := []struct {
+		name     string
+		code     string
+		exit     int
+		attempts int
+	}{
+		{"unknown method", rpclab.ErrUnknownMethod, 1, 1},
+		{"no code", "", 1, 1},
+		{"retryable code", rpclab.ErrRateLimited, 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, seen := errorOnceServer(t, tt.code)
+			c := rpclab.NewClient(addr, rpclab.ClientConfig{Timeout: 5 * time.Second})
+			defer c.Close()
+			opts := &callOptions{server: addr, maxRetries: 3, outputFormat: "json"}
+			code := runCall(c, opts, &rpclab.Request{RequestID: "r1", Method: "ping"})
+			if code != tt.exit {
+				t.Errorf("exit code = %d, want %d", code, tt.exit)
+			}
+			if n := seen.Load(); n != int64(tt.attempts) {
+				t.Errorf("server saw %d attempts, want %d", n, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestReadParams(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "params.json")
+	if err := os.WriteFile(file, []byte(`{"from":"file"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		set       bool
+		fromStdin bool
+		file      string
+		want      string // "" when an error is expected
+	}{
+		{"inline", true, false, "", `{"from":"inline"}`},
+		{"stdin", false, true, "", `{"from":"stdin"}`},
+		{"file", false, false, file, `{"from":"file"}`},
+		{"file from stdin", false, false, "-", `{"from":"stdin"}`},
+		{"stdin and -params", true, true, "", ""},
+		{"file and -params", true, false, file, ""},
+		{"file and stdin", false, true, file, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readParams(strings.NewReader(`{"from":"stdin"}`), `{"from":"inline"}`, tt.set, tt.fromStdin, tt.file)
+			if (err != nil) != (tt.want == "") {
+				t.Fatalf("err = %v, want error %t", err, tt.want == "")
+			}
+			if string(got) != tt.want {
+				t.Errorf("params = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLargeParamsFromStdin(t *testing.T) {
+	addr := startServer(t, nil)
+	// far past what a shell argument comfortably holds
+	blob := map[string]interface{}{"text": strings.Repeat("lorem ipsum ", 40000), "n": json.Number("12345678901234567")}
+	in, err := json.Marshal(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := readParams(bytes.NewReader(in), "{}", false, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var params map[string]interface{}
+	if err := rpclab.DecodeJSON(raw, &params); err != nil {
+		t.Fatal(err)
+	}
+	c := rpclab.NewClient(addr, rpclab.ClientConfig{Timeout: 5 * time.Second})
+	defer c.Close()
+	resp, err := c.Call("echo", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := json.Marshal(resp.Result)
+	if !bytes.Equal(out, in) {
+		t.Errorf("echoed %d bytes that differ from the %d sent", len(out), len(in))
+	}
+}
+
+func TestParseLocalAddr(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"127.0.0.1", "127.0.0.1:0", false},
+		{"127.0.0.1:4100", "127.0.0.1:4100", false},
+		{"::1", "[::1]:0", false},
+		{"[::1]:4100", "[::1]:4100", false},
+		{"127.0.0.1:port", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			a, err := parseLocalAddr(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && a.String() != tt.want {
+				t.Errorf("parseLocalAddr(%q) = %s, want %s", tt.in, a, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckServerAddr(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string // "" for a valid address
+	}{
+		{"[::1]:5000", ""},
+		{"localhost:5000", ""},
+		{"127.0.0.1:5000", ""},
+		{"localhost", `"localhost": missing port, e.g. localhost:6000`},
+		{"::1", `"::1": IPv6 addresses need brackets and a port, e.g. [::1]:6000`},
+		{"[::1]", `"[::1]": IPv6 addresses need brackets and a port, e.g. [::1]:6000`},
+		{"localhost:port99", `"localhost:port99": invalid port "port99"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			err := checkServerAddr(tt.in)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("checkServerAddr(%q) = %v, want nil", tt.in, err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("checkServerAddr(%q) = %v, want %q", tt.in, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestOutputFormatFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "pretty"},
+		{[]string{"-output-format", "csv"}, "csv"},
+		{[]string{"-output", "json"}, "json"},
+		{[]string{"-output=result"}, "result"},
+		// the last one given wins, as with a repeated flag
+		{[]string{"-output", "json", "-output-format", "table"}, "table"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			fs := flag.NewFlagSet("rpc-client", flag.ContinueOnError)
+			format := outputFormatFlags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if *format != tt.want {
+				t.Errorf("format = %q, want %q", *format, tt.want)
+			}
+		})
+	}
+}
+
+func TestComputeBackoff(t *testing.T) {
+	const base, max = 200 * time.Millisecond, 10 * time.Second
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{6, 6400 * time.Millisecond},
+		{7, max},
+		{10, max},
+		{10000, max},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.attempt), func(t *testing.T) {
+			if got := computeBackoff(tt.attempt, base, max, 0); got != tt.want {
+				t.Errorf("computeBackoff(%d) = %s, want %s", tt.attempt, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("monotonic up to the cap", func(t *testing.T) {
+		prev := time.Duration(0)
+		for attempt := 1; attempt <= 100; attempt++ {
+			got := computeBackoff(attempt, base, max, 0)
+			if got < prev || got > max {
+				t.Fatalf("attempt %d: %s after %s, cap %s", attempt, got, prev, max)
+			}
+			prev = got
+		}
+	})
+
+	t.Run("base above the cap", func(t *testing.T) {
+		if got := computeBackoff(1, time.Minute, max, 0); got != max {
+			t.Errorf("got %s, want the %s cap", got, max)
+		}
+	})
+
+	t.Run("jitter stays in range", func(t *testing.T) {
+		const jitter = 50 * time.Millisecond
+		for i := 0; i < 200; i++ {
+			got := computeBackoff(3, base, max, jitter)
+			if got < 800*time.Millisecond || got >= 800*time.Millisecond+jitter {
+				t.Fatalf("got %s, want within [800ms, 850ms)", got)
+			}
+		}
+	})
+}
+
+func TestSequentialIDs(t *testing.T) {
+	next := sequentialIDs("myjob")
+	for _, want := range []string{"myjob-0001", "myjob-0002", "myjob-0003"} {
+		if got := next(); got != want {
+			t.Fatalf("id = %s, want %s", got, want)
+		}
+	}
+
+	// -concurrency workers share one generator
+	next = sequentialIDs("w")
+	ids := make(chan string, 400)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ids <- next()
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	seen := map[string]bool{}
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("duplicate id %s", id)
+		}
+		seen[id] = true
+	}
+	if !seen["w-0001"] || !seen["w-0400"] {
+		t.Errorf("ids don't run w-0001..w-0400")
+	}
+}
@@ -0,0 +1,293 @@
+// Package servercmd implements the rpc-server command, which serves the
+// rpclab methods over TCP or UDP. server.go at the repository root is its
+// main.
+package servercmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/yourusername/rpc-go-lab/rpclab"
+)
+
+// Main runs the rpc-server command with the process arguments
+func Main() {
+	cfg := rpclab.DefaultConfig()
+	flag.IntVar(&cfg.Port, "port", cfg.Port, "port to listen on")
+	flag.StringVar(&cfg.Protocol, "protocol", cfg.Protocol, "message format: native or jsonrpc2 (JSON-RPC 2.0)")
+	flag.StringVar(&cfg.Transport, "transport", cfg.Transport, "tcp, or udp for one request per datagram (no TLS, framing or gzip; replies over 64KiB are dropped)")
+	flag.StringVar(&cfg.Addr, "addr", cfg.Addr, "address to bind")
+	clockSource := flag.String("server-clock-source", "system", "time source: 'system' or a fixed RFC3339 time")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "PEM certificate file; with -tls-key, serve TLS instead of plaintext")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "PEM private key file for -tls-cert")
+	flag.BoolVar(&cfg.TLSReload, "tls-reload", false, "reload -tls-cert and -tls-key when the files change or on SIGHUP, keeping the old pair if the new one fails to load")
+	flag.DurationVar(&cfg.HandshakeTimeout, "handshake-timeout", cfg.HandshakeTimeout, "drop TLS clients that have not finished the handshake within this time (0 = no limit)")
+	flag.IntVar(&cfg.BindRetries, "bind-retries", 0, "extra attempts to bind the port if it is busy")
+	flag.DurationVar(&cfg.BindRetryDelay, "bind-retry-delay", cfg.BindRetryDelay, "delay between bind attempts")
+	flag.Uint64Var(&cfg.MaxRequestMemory, "max-request-memory", 0, "soft per-request allocation limit in bytes (0 = unlimited)")
+	flag.BoolVar(&cfg.RequireTimestamp, "require-timestamp", false, "reject requests without a timestamp")
+	flag.StringVar(&cfg.AuthToken, "auth-token", "", "shared token requests must send in auth_token; others get code unauthorized (empty = no auth)")
+	flag.DurationVar(&cfg.MaxSleep, "max-sleep", cfg.MaxSleep, "reject sleep requests longer than this with code bad_params (0 = unlimited)")
+	flag.IntVar(&cfg.MaxRequestsPerConn, "max-requests-per-conn", 0, "close a connection after this many requests, flagging the last response with close: true (0 = unlimited)")
+	flag.BoolVar(&cfg.Strict, "strict", false, "one request per connection; reject any data sent after it with code malformed_stream")
+	flag.DurationVar(&cfg.MaxClockSkew, "max-clock-skew", 0, "max allowed request timestamp skew from the server clock (0 = unchecked)")
+	flag.StringVar(&cfg.MaxClockSkewAction, "max-clock-skew-action", cfg.MaxClockSkewAction, "what to do with skewed requests: reject or warn")
+	flag.IntVar(&cfg.MaxParamsKeys, "max-params-keys", 0, "max number of top-level params keys (0 = unlimited)")
+	flag.IntVar(&cfg.MaxStringLen, "max-string-len", 0, "max length in bytes of any string param (0 = unlimited)")
+	flag.DurationVar(&cfg.ReadTimeout, "read-timeout", 0, "close connections that take longer than this to send a request (0 = no limit)")
+	flag.BoolVar(&cfg.GracefulCloseOnIdle, "graceful-close-on-idle", false, "before closing an idle connection at -read-timeout, send a GOODBYE frame and still answer a request already in flight")
+	flag.IntVar(&cfg.WriteRate, "write-rate", 0, "throttle response writes to this many bytes/sec to simulate a slow link (0 = unlimited)")
+	flag.BoolVar(&cfg.Debug, "debug", false, "enable debug logging")
+	flag.BoolVar(&cfg.EnableCrash, "enable-crash", false, "enable the sleep_then_crash failure method (same as -enable-methods=sleep_then_crash)")
+	flag.BoolVar(&cfg.EnableReflection, "enable-reflection", false, "enable the reflect service descriptor method (same as -enable-methods=reflect)")
+	flag.StringVar(&cfg.JSONNumberMode, "json-number-mode", cfg.JSONNumberMode, "numeric result encoding: int (integers where exact), float, or string")
+	flag.StringVar(&cfg.ResponseChecksum, "response-checksum", "", "attach a checksum of the serialized result: crc32 or sha256 (empty = off)")
+	flag.IntVar(&cfg.LogSlowestRequests, "log-slowest-requests", cfg.LogSlowestRequests, "number of slowest requests to keep for the slowest method (0 = off)")
+	flag.Int64Var(&cfg.MaxDecompressedBytes, "max-decompressed-bytes", cfg.MaxDecompressedBytes, "max size of a gzip-compressed request once decompressed")
+	flag.Int64Var(&cfg.MaxCompressionRatio, "max-compression-ratio", cfg.MaxCompressionRatio, "max decompressed/compressed ratio for gzip requests")
+	flag.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", 0, "replay the cached response to requests repeating an id seen within this long (0 = off)")
+	flag.IntVar(&cfg.IdempotencySize, "idempotency-size", cfg.IdempotencySize, "max request ids kept in the idempotency cache")
+	flag.DurationVar(&cfg.Warmup, "warmup", 0, "after startup, answer only ping for this long")
+	flag.StringVar(&cfg.MetricsAddr, "metrics-addr", "", "serve Prometheus metrics over HTTP at this host:port under /metrics (empty = off)")
+	flag.StringVar(&cfg.LogFile, "log-file", "", "append one JSON object per handled request to this file")
+	flag.DurationVar(&cfg.RetryWindow, "retry-window", cfg.RetryWindow, "how long request ids are remembered to detect client retries")
+	flag.Var(defaultParamsFlag(cfg.DefaultParams), "default-params", "per-method default params as method=json, e.g. 'slow={\"sleep\":2}' (repeatable)")
+	flag.StringVar(&cfg.Framing, "framing", cfg.Framing, "wire framing: json (bare objects) or length (4-byte big-endian length prefix)")
+	flag.IntVar(&cfg.MaxFrameSize, "max-frame-size", cfg.MaxFrameSize, "max size in bytes of a single frame in length framing")
+	flag.Int64Var(&cfg.MaxRequestBytes, "max-request-bytes", cfg.MaxRequestBytes, "max size in bytes of a single request in json framing (0 = unlimited)")
+	flag.BoolVar(&cfg.ResultPaging, "result-paging", cfg.ResultPaging, "page array results when requests pass limit/offset params")
+	flag.BoolVar(&cfg.TimingDetail, "timing-detail", false, "include decode/queue/handler/encode timings in responses")
+	flag.BoolVar(&cfg.NoTiming, "no-timing", false, "don't report the method's duration_ms in responses")
+	flag.IntVar(&cfg.MaxActiveRequests, "max-active-requests", 0, "max requests executing at once across all connections (0 = unlimited)")
+	flag.IntVar(&cfg.RoundFloats, "round-floats", cfg.RoundFloats, "round float results to this many decimals (-1 = off)")
+	flag.BoolVar(&cfg.SnakeCaseKeys, "snake-case-keys", false, "convert object keys in results to snake_case")
+	flag.Float64Var(&cfg.MaxAcceptRate, "max-accept-rate", 0, "max new connections accepted per second (0 = unlimited)")
+	flag.StringVar(&cfg.Banlist, "banlist", "", "file of IPs/CIDRs (one per line) whose connections are refused; reloaded on change")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "how long to wait for active connections to finish on SIGINT/SIGTERM")
+	flag.IntVar(&cfg.MaxConcurrent, "max-concurrent", 0, "max connections served at once (0 = unlimited)")
+	flag.StringVar(&cfg.MaxConcurrentMode, "max-concurrent-mode", cfg.MaxConcurrentMode, "what to do with connections over -max-concurrent: reject or queue")
+	flag.IntVar(&cfg.Workers, "workers", 0, "serve connections on this many pooled goroutines instead of one goroutine each (0 = goroutine per connection)")
+	flag.IntVar(&cfg.WorkerQueue, "worker-queue", cfg.WorkerQueue, "with -workers, accepted connections that may wait for a free worker")
+	flag.StringVar(&cfg.WorkerQueuePolicy, "worker-queue-policy", cfg.WorkerQueuePolicy, "with -workers, what to do when the queue is full: reject (answer server_busy) or drop (close silently)")
+	flag.DurationVar(&cfg.MaxConcurrentQueueWait, "max-concurrent-queue-wait", cfg.MaxConcurrentQueueWait, "in queue mode, how long a connection waits for a slot before being rejected")
+	flag.Float64Var(&cfg.Rate, "rate", 0, "max requests per second from one client IP (0 = unlimited)")
+	flag.IntVar(&cfg.Burst, "burst", 0, "requests a client IP may send in a burst above -rate (0 = same as -rate)")
+	flag.IntVar(&cfg.MaxConnsPerIP, "max-conns-per-ip", 0, "max concurrent connections from one IP (0 = unlimited)")
+	flag.Var((*methodListFlag)(&cfg.EnableMethods), "enable-methods", "comma-separated methods to enable that are off by default (crash, sleep_then_crash, sleep_random, reflect)")
+	flag.Var((*methodListFlag)(&cfg.DisableMethods), "disable-methods", "comma-separated methods to refuse with code method_disabled")
+	flag.Var((*methodListFlag)(&cfg.SlowMethods), "slow-methods", "comma-separated methods treated as expensive")
+	flag.IntVar(&cfg.SlowWorkers, "slow-workers", 0, "size of the separate worker pool for expensive methods (0 = run them inline)")
+	flag.DurationVar(&cfg.MaxQueueWait, "max-queue-wait", 0, "drop slow-pool requests that wait longer than this for a worker (0 = wait forever)")
+	flag.Func("method-timeout", "comma-separated method=duration handler budgets, e.g. add=1s,slow=30s", func(v string) error {
+		m, err := parseMethodTimeouts(v)
+		if err == nil {
+			cfg.MethodTimeouts = m
+		}
+		return err
+	})
+	flag.IntVar(&cfg.MethodCallBudget, "method-call-budget", 0, "total -method-cost a connection may spend; later calls get \"connection budget exhausted\" (0 = unlimited)")
+	flag.Func("method-cost", "comma-separated method=weight costs against -method-call-budget, e.g. slow=10,add=1 (default 1 per call)", func(v string) error {
+		m, err := parseMethodCosts(v)
+		if err == nil {
+			cfg.MethodCosts = m
+		}
+		return err
+	})
+	flag.DurationVar(&cfg.DefaultMethodTimeout, "default-method-timeout", cfg.DefaultMethodTimeout, "handler budget for methods not in -method-timeout; keep it above -max-sleep (0 = unlimited)")
+	configPath := flag.String("config", "", "JSON file of flag values keyed by flag name, e.g. {\"port\": 6000, \"rate\": 5}; command-line flags win")
+	flag.Parse()
+
+	if *configPath != "" {
+		if err := applyConfigFile(*configPath); err != nil {
+			log.Fatalf("config: %v", err)
+		}
+	}
+	c, err := rpclab.ParseClockSource(*clockSource)
+	if err != nil {
+		log.Fatalf("invalid -server-clock-source: %v", err)
+	}
+	cfg.Clock = c
+
+	srv, err := rpclab.NewServer(cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// SIGUSR1 toggles quiesce mode for maintenance windows
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			srv.SetQuiesced(!srv.Quiesced())
+		}
+	}()
+	// SIGHUP picks up renewed certificates with -tls-reload
+	if cfg.TLSReload {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := srv.ReloadTLS(); err != nil {
+					log.Printf("TLS reload failed, keeping the current certificate: %v", err)
+					continue
+				}
+				log.Printf("TLS certificate reloaded on SIGHUP")
+			}
+		}()
+	}
+	// SIGINT/SIGTERM stop accepting and let active connections drain
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	exitCode := make(chan int)
+	go func() {
+		sig := <-stop
+		log.Printf("Received %v, shutting down (timeout %v)", sig, cfg.ShutdownTimeout)
+		code := 1
+		if srv.Shutdown() {
+			code = 0
+		}
+		exitCode <- code
+	}()
+
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	os.Exit(<-exitCode)
+}
+
+// methodListFlag is a comma-separated, case-insensitive list of method names
+type methodListFlag []string
+
+func (f *methodListFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *methodListFlag) Set(v string) error {
+	*f = splitMethods(v)
+	return nil
+}
+
+// defaultParamsFlag collects repeated -default-params method=json values
+type defaultParamsFlag map[string]map[string]interface{}
+
+func (f defaultParamsFlag) String() string {
+	b, _ := json.Marshal(map[string]map[string]interface{}(f))
+	return string(b)
+}
+
+func (f defaultParamsFlag) Set(v string) error {
+	method, js, ok := strings.Cut(v, "=")
+	method = strings.ToLower(strings.TrimSpace(method))
+	if !ok || method == "" {
+		return errors.New("want method=json")
+	}
+	var params map[string]interface{}
+	if err := rpclab.DecodeJSON([]byte(js), &params); err != nil || params == nil {
+		return fmt.Errorf("params for %s must be a JSON object", method)
+	}
+	if f[method] == nil {
+		f[method] = map[string]interface{}{}
+	}
+	for k, pv := range params {
+		f[method][k] = pv
+	}
+	return nil
+}
+
+// applyConfigFile sets every flag named in the JSON object at path that
+// wasn't given on the command line. Values may be JSON strings, numbers or
+// booleans, written as the flag would take them ("10s" for durations).
+func applyConfigFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown key %q", path, name)
+		}
+		if explicit[name] {
+			continue
+		}
+		raw := bytes.TrimSpace(values[name])
+		v := string(raw)
+		if len(raw) > 0 && raw[0] == '"' {
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return fmt.Errorf("%s: key %q: %v", path, name, err)
+			}
+		} else if len(raw) == 0 || raw[0] == '{' || raw[0] == '[' || v == "null" {
+			return fmt.Errorf("%s: key %q: want a string, number or boolean", path, name)
+		}
+		if err := flag.Set(name, v); err != nil {
+			return fmt.Errorf("%s: key %q: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// parseMethodTimeouts parses a -method-timeout list
+func parseMethodTimeouts(list string) (map[string]time.Duration, error) {
+	out := map[string]time.Duration{}
+	for _, entry := range splitMethods(list) {
+		name, v, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !rpclab.KnownMethod(name) {
+			return nil, fmt.Errorf("-method-timeout: want method=duration for a known method, got %q", entry)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("-method-timeout: invalid duration for %s: %q", name, v)
+		}
+		out[name] = d
+	}
+	return out, nil
+}
+
+// parseMethodCosts parses a -method-cost list
+func parseMethodCosts(list string) (map[string]int, error) {
+	out := map[string]int{}
+	for _, entry := range splitMethods(list) {
+		name, v, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !rpclab.KnownMethod(name) {
+			return nil, fmt.Errorf("-method-cost: want method=weight for a known method, got %q", entry)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("-method-cost: invalid weight for %s: %q", name, v)
+		}
+		out[name] = n
+	}
+	return out, nil
+}
+
+// splitMethods parses a comma-separated, case-insensitive method list
+func splitMethods(list string) []string {
+	var out []string
+	for _, m := range strings.Split(list, ",") {
+		if m = strings.ToLower(strings.TrimSpace(m)); m != "" {
+			out = append(out, m)
+		}
+	}
+	return out
+}
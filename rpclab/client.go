@@ -0,0 +1,656 @@
+package rpclab
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientConfig holds the settings a Client dials and calls with. The zero
+// value speaks plain TCP in json framing with no call timeout.
+type ClientConfig struct {
+	Timeout        time.Duration // bounds each call, including the dial
+	PoolSize       int           // idle connections kept for reuse (0 = dial per call)
+	PoolConnTTL    time.Duration // connections older than this are closed, not reused (0 = no limit)
+	Transport      string        // "tcp" (default) or "udp"; over udp each call is one datagram each way
+	Framing        string        // "json" (default) or "length"; must match the server
+	MaxFrameSize   int           // largest frame accepted in length framing (0 = 1MiB)
+	Compress       bool          // gzip requests of CompressThreshold bytes or more
+	TLS            *tls.Config   // nil = plaintext
+	LocalAddr      *net.TCPAddr  // source address to dial from (nil lets the OS choose)
+	VerifyChecksum bool          // verify the server's result checksums
+	AuthToken      string        // sent as auth_token on every request, on the wire only
+	NewRequestID   func() string // ids for Call (nil = NewRequestID)
+	Breaker        *Breaker      // circuit breaker, possibly shared by several Clients (nil = none)
+
+	// ReconnectOnError retries a Call once on a freshly dialed connection
+	// when its connection fails, e.g. one the server dropped while idle.
+	// The request may have reached the server, so only set it for calls
+	// that are safe to repeat.
+	ReconnectOnError bool
+
+	// Dial opens connections to the server over "tcp" or "udp". The nil
+	// default dials with Timeout and LocalAddr and does the TLS handshake;
+	// a custom Dial must do its own TLS.
+	Dial func(network, addr string) (net.Conn, error)
+}
+
+// Client issues calls to one server, keeping up to PoolSize idle
+// connections around for reuse. It is safe for concurrent use.
+type Client struct {
+	server  string
+	cfg     ClientConfig
+	breaker *Breaker // nil when disabled
+
+	mu   sync.Mutex
+	idle []*rpcConn
+
+	// with a PoolConnTTL, a sweep prunes expired idle connections until Close
+	stopSweep chan struct{}
+	closeOnce sync.Once
+}
+
+// NewClient returns a Client for server
+func NewClient(server string, cfg ClientConfig) *Client {
+	if cfg.Transport == "" {
+		cfg.Transport = "tcp"
+	}
+	if cfg.Framing == "" {
+		cfg.Framing = "json"
+	}
+	if cfg.MaxFrameSize <= 0 {
+		cfg.MaxFrameSize = 1 << 20
+	}
+	if cfg.NewRequestID == nil {
+		cfg.NewRequestID = NewRequestID
+	}
+	c := &Client{server: server, cfg: cfg, breaker: cfg.Breaker}
+	if cfg.PoolConnTTL > 0 && cfg.PoolSize > 0 {
+		c.stopSweep = make(chan struct{})
+		go c.sweepLoop(cfg.PoolConnTTL / 2)
+	}
+	return c
+}
+
+// Call sends method with params as a new request
+func (c *Client) Call(method string, params map[string]interface{}) (*Response, error) {
+	return c.Do(&Request{
+		RequestID: c.cfg.NewRequestID(),
+		Method:    method,
+		Params:    params,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+}
+
+// Do sends a prepared request, e.g. a retry that must keep its request id
+func (c *Client) Do(req *Request) (*Response, error) {
+	req = c.withAuth(req)
+	resp, err := c.do(req, false)
+	if err != nil && resp == nil && c.cfg.ReconnectOnError && connectionError(err) {
+		log.Printf("Reconnecting after connection error: %v", err)
+		resp, err = c.do(req, true)
+	}
+	return resp, err
+}
+
+// do makes one attempt at req, on a new connection when fresh is set
+func (c *Client) do(req *Request, fresh bool) (*Response, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	get := c.get
+	if fresh {
+		get = c.dial
+	}
+	conn, err := get()
+	if err != nil {
+		c.breaker.record(err)
+		return nil, err
+	}
+	resp, err := conn.call(req, c.cfg.Timeout)
+	c.breaker.record(err)
+	// a close hint means the next call must dial a new connection
+	c.release(conn, (err != nil && resp == nil) || (resp != nil && resp.Close))
+	return resp, err
+}
+
+// Stream sends req on a new connection and calls fn with each response
+// until the server closes the connection; timeout bounds the wait for each
+// frame. The connection is never pooled.
+func (c *Client) Stream(req *Request, fn func(*Response) error) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	conn, err := c.dial()
+	c.breaker.record(err)
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+	return conn.stream(c.withAuth(req), c.cfg.Timeout, fn)
+}
+
+// ErrCircuitOpen is returned without contacting the server while the
+// Client's circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Breaker counts consecutive transport failures. At the threshold it opens
+// and rejects calls until the cooldown has passed, then it is half-open: one
+// probe call is let through, and its outcome closes or reopens the breaker.
+// Application errors show the server is up, so they count as successes.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	probing  bool // a half-open probe call is in flight
+}
+
+// NewBreaker returns a Breaker that opens after threshold consecutive
+// transport failures for cooldown, or nil (always closed) for threshold <= 0
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &Breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns ErrCircuitOpen while calls must fail fast
+func (b *Breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return nil
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	log.Printf("Circuit breaker half-open: sending a probe call")
+	return nil
+}
+
+// record notes the outcome of a call allow let through
+func (b *Breaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil || errors.Is(err, ErrServerApplication) {
+		if b.open {
+			log.Printf("Circuit breaker closed")
+		}
+		b.failures, b.open, b.probing = 0, false, false
+		return
+	}
+	b.failures++
+	if b.probing || (!b.open && b.failures >= b.threshold) {
+		log.Printf("Circuit breaker open for %v after %d consecutive failures", b.cooldown, b.failures)
+		b.open, b.openedAt, b.probing = true, time.Now(), false
+	}
+}
+
+// withAuth returns req with the auth token set, leaving the caller's copy alone
+func (c *Client) withAuth(req *Request) *Request {
+	if c.cfg.AuthToken == "" {
+		return req
+	}
+	r := *req
+	r.AuthToken = c.cfg.AuthToken
+	return &r
+}
+
+// DoBatch sends reqs as a single batch
+func (c *Client) DoBatch(reqs []Request) ([]Response, error) {
+	if c.cfg.AuthToken != "" {
+		reqs = append([]Request(nil), reqs...)
+		for i := range reqs {
+			reqs[i].AuthToken = c.cfg.AuthToken
+		}
+	}
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	conn, err := c.get()
+	if err != nil {
+		c.breaker.record(err)
+		return nil, err
+	}
+	resps, err := conn.callBatch(reqs, c.cfg.Timeout)
+	c.breaker.record(err)
+	closing := false
+	for _, r := range resps {
+		closing = closing || r.Close
+	}
+	c.release(conn, err != nil || closing)
+	return resps, err
+}
+
+// Close closes all idle connections and stops the PoolConnTTL sweep
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		if c.stopSweep != nil {
+			close(c.stopSweep)
+		}
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.idle {
+		conn.close()
+	}
+	c.idle = nil
+}
+
+// get hands out an idle connection that still looks usable, or dials a new one
+func (c *Client) get() (*rpcConn, error) {
+	c.mu.Lock()
+	for len(c.idle) > 0 {
+		conn := c.idle[len(c.idle)-1]
+		c.idle = c.idle[:len(c.idle)-1]
+		if !c.expired(conn) && conn.usable() {
+			c.mu.Unlock()
+			return conn, nil
+		}
+		conn.close()
+	}
+	c.mu.Unlock()
+	return c.dial()
+}
+
+// release returns conn to the pool, or closes it when broken or the pool is full
+func (c *Client) release(conn *rpcConn, broken bool) {
+	if broken {
+		// the connection's state is unknown after a transport error
+		conn.close()
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= c.cfg.PoolSize || c.expired(conn) {
+		conn.close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// expired reports whether conn has outlived the PoolConnTTL
+func (c *Client) expired(conn *rpcConn) bool {
+	return c.cfg.PoolConnTTL > 0 && time.Since(conn.created) >= c.cfg.PoolConnTTL
+}
+
+// sweepLoop closes expired idle connections every interval until Close, so
+// a quiet client doesn't hold on to connections the server may have dropped
+func (c *Client) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopSweep:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		live := c.idle[:0]
+		for _, conn := range c.idle {
+			if c.expired(conn) {
+				conn.close()
+			} else {
+				live = append(live, conn)
+			}
+		}
+		c.idle = live
+		c.mu.Unlock()
+	}
+}
+
+// rpcConn is a client connection that can carry several calls in sequence.
+// The server answers in order, so each call reads exactly one response.
+type rpcConn struct {
+	conn           net.Conn
+	codec          wireCodec
+	verifyChecksum bool
+	created        time.Time
+}
+
+// dial opens a new connection to the server
+func (c *Client) dial() (*rpcConn, error) {
+	network := "tcp"
+	if c.cfg.Transport == "udp" {
+		network = "udp"
+	}
+	dial := c.cfg.Dial
+	if dial == nil {
+		dial = c.dialNet
+	}
+	conn, err := dial(network, c.server)
+	if err != nil {
+		return nil, fmt.Errorf("dial error: %w", err)
+	}
+	if network == "udp" {
+		return &rpcConn{conn: conn, codec: &datagramCodec{conn: conn}, verifyChecksum: c.cfg.VerifyChecksum, created: time.Now()}, nil
+	}
+	return &rpcConn{conn: conn, codec: c.newCodec(conn), verifyChecksum: c.cfg.VerifyChecksum, created: time.Now()}, nil
+}
+
+// dialNet is the default Dial
+func (c *Client) dialNet(network, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: c.cfg.Timeout}
+	if a := c.cfg.LocalAddr; a != nil {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: a.IP, Port: a.Port}
+		} else {
+			d.LocalAddr = a
+		}
+	}
+	if network == "tcp" && c.cfg.TLS != nil {
+		// the dialer timeout covers the handshake as well as the connect
+		return tls.DialWithDialer(&d, network, addr, c.cfg.TLS)
+	}
+	return d.Dial(network, addr)
+}
+
+// newCodec frames messages on conn as configured; with Compress, large
+// requests go out compressed and compressed replies are expanded
+func (c *Client) newCodec(conn net.Conn) wireCodec {
+	if c.cfg.Framing == "length" {
+		return &lengthCodec{r: conn, w: conn, max: c.cfg.MaxFrameSize, compressed: c.cfg.Compress}
+	}
+	return &jsonCodec{in: newMessageReader(conn, 0, errResponseTooLarge), w: conn, enc: json.NewEncoder(conn), compressed: c.cfg.Compress}
+}
+
+func (c *rpcConn) close() error {
+	return c.conn.Close()
+}
+
+// usable reports whether an idle connection can carry another call: the
+// server must not have closed it or sent anything unsolicited. The read
+// deadline is slightly in the future because an already expired one fails
+// before the socket is even looked at.
+func (c *rpcConn) usable() bool {
+	if err := c.conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	var b [1]byte
+	_, err := c.conn.Read(b[:])
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func (c *rpcConn) call(req *Request, timeout time.Duration) (*Response, error) {
+	// set deadline for read+write
+	deadline := time.Now().Add(timeout)
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("set deadline: %w", err)
+	}
+
+	if err := c.codec.writeMessage(req); err != nil {
+		return nil, fmt.Errorf("encode/send: %w", err)
+	}
+	if req.Oneway {
+		// nothing comes back for fire-and-forget requests
+		return nil, nil
+	}
+
+	var raw []byte
+	var resp Response
+	for {
+		var err error
+		raw, err = c.codec.readMessage()
+		if err != nil {
+			return nil, receiveError(err)
+		}
+		resp = Response{}
+		if err := DecodeJSON(raw, &resp); err != nil {
+			return nil, fmt.Errorf("decode/receive: %w", err)
+		}
+		// the server closed the connection for idleness as this request went
+		// out; it still answers a request that reaches it shortly after
+		if resp.Status != "GOODBYE" {
+			break
+		}
+	}
+	if c.verifyChecksum {
+		if err := checkResultChecksum(raw, resp.Checksum); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure request_id matches; on a shared connection a mismatch means
+	// we've lost track of which response belongs to which call. An error with
+	// no id is the server rejecting a request it could not read at all.
+	unreadable := resp.Status == "ERROR" && resp.RequestID == ""
+	if !unreadable && strings.TrimSpace(resp.RequestID) != req.RequestID {
+		return nil, fmt.Errorf("mismatched request id in response: got %s expected %s", resp.RequestID, req.RequestID)
+	}
+
+	if resp.Status != "OK" {
+		return &resp, newServerError(&resp)
+	}
+	return &resp, nil
+}
+
+// stream writes req, then half-closes the connection so the server hangs up
+// once it has answered, and reads frames until then. A method that doesn't
+// stream simply yields a single frame.
+func (c *rpcConn) stream(req *Request, timeout time.Duration, fn func(*Response) error) error {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+	if err := c.codec.writeMessage(req); err != nil {
+		return fmt.Errorf("encode/send: %w", err)
+	}
+	if hc, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		if err := hc.CloseWrite(); err != nil {
+			return fmt.Errorf("close write: %w", err)
+		}
+	}
+	for frames := 0; ; frames++ {
+		raw, err := c.codec.readMessage()
+		if errors.Is(err, io.EOF) && frames > 0 {
+			return nil
+		}
+		if err != nil {
+			return receiveError(err)
+		}
+		var resp Response
+		if err := DecodeJSON(raw, &resp); err != nil {
+			return fmt.Errorf("decode/receive: %w", err)
+		}
+		unreadable := resp.Status == "ERROR" && resp.RequestID == ""
+		if !unreadable && strings.TrimSpace(resp.RequestID) != req.RequestID {
+			return fmt.Errorf("mismatched request id in response: got %s expected %s", resp.RequestID, req.RequestID)
+		}
+		if resp.Status != "OK" {
+			return newServerError(&resp)
+		}
+		if err := fn(&resp); err != nil {
+			return err
+		}
+		if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return fmt.Errorf("set deadline: %w", err)
+		}
+	}
+}
+
+// ErrServerClosed matches a read cut short because the server closed the
+// connection, e.g. when it exits right after a request. It is retryable.
+var ErrServerClosed = errors.New("server closed connection without a complete response")
+
+// receiveError wraps a failure to read a response, telling a connection
+// the server closed apart from one that sent something unreadable
+func receiveError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w (%v)", ErrServerClosed, err)
+	}
+	return fmt.Errorf("decode/receive: %w", err)
+}
+
+// connectionError reports whether err means the connection itself failed:
+// closed by the server, reset or refused. Timeouts are left out because the
+// server may still be working on the request.
+func connectionError(err error) bool {
+	if errors.Is(err, ErrServerClosed) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && !ne.Timeout()
+}
+
+// ErrServerApplication matches calls the server answered with Status "ERROR",
+// as opposed to transport failures where no valid answer came back
+var ErrServerApplication = errors.New("server error")
+
+// ServerError is an ERROR response; it unwraps to ErrServerApplication
+type ServerError struct {
+	Code       string // empty from older servers
+	Message    string
+	RetryAfter time.Duration // the server's retry_after_ms hint, 0 if none
+}
+
+func newServerError(resp *Response) *ServerError {
+	return &ServerError{Code: resp.Code, Message: resp.Error, RetryAfter: time.Duration(resp.RetryAfterMs) * time.Millisecond}
+}
+
+func (e *ServerError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("server error [%s]: %s", e.Code, e.Message)
+	}
+	return "server error: " + e.Message
+}
+
+func (e *ServerError) Unwrap() error { return ErrServerApplication }
+
+// DefaultRetryCodes are the server error codes Retryable treats as
+// transient: the server turned the request away for load or readiness
+var DefaultRetryCodes = []string{ErrUnavailable, ErrNotReady, ErrServerBusy, ErrRateLimited}
+
+// Retryable reports whether another attempt could succeed: transport and
+// timeout failures can, an application error won't unless the server only
+// turned the request away for load
+func Retryable(err error) bool {
+	return RetryableOn(err, DefaultRetryCodes)
+}
+
+// RetryableOn is Retryable with codes as the server errors worth retrying
+func RetryableOn(err error, codes []string) bool {
+	if errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	if !errors.Is(err, ErrServerApplication) {
+		return true
+	}
+	var se *ServerError
+	if errors.As(err, &se) {
+		for _, c := range codes {
+			if se.Code == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RetryAfter returns the wait the server asked for with err, 0 if none
+func RetryAfter(err error) time.Duration {
+	var se *ServerError
+	if errors.As(err, &se) {
+		return se.RetryAfter
+	}
+	return 0
+}
+
+// callBatch sends reqs as one JSON array and reads back the array of
+// responses. Oneway elements get no entry, so a batch made only of oneway
+// requests returns nil.
+func (c *rpcConn) callBatch(reqs []Request, timeout time.Duration) ([]Response, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("set deadline: %w", err)
+	}
+	if err := c.codec.writeMessage(reqs); err != nil {
+		return nil, fmt.Errorf("encode/send: %w", err)
+	}
+	expected := 0
+	for _, r := range reqs {
+		if !r.Oneway {
+			expected++
+		}
+	}
+	if expected == 0 {
+		return nil, nil
+	}
+
+	raw, err := c.codec.readMessage()
+	if err != nil {
+		return nil, receiveError(err)
+	}
+	var elems []json.RawMessage
+	if err := json.Unmarshal(raw, &elems); err != nil {
+		// a single object means the server rejected the batch as a whole
+		var resp Response
+		if DecodeJSON(raw, &resp) == nil && resp.Status == "ERROR" {
+			return nil, newServerError(&resp)
+		}
+		return nil, fmt.Errorf("decode/receive: %w", err)
+	}
+	if len(elems) != expected {
+		return nil, fmt.Errorf("batch response has %d entries, expected %d", len(elems), expected)
+	}
+	resps := make([]Response, len(elems))
+	for i, e := range elems {
+		if err := DecodeJSON(e, &resps[i]); err != nil {
+			return nil, fmt.Errorf("decode/receive: %w", err)
+		}
+		if c.verifyChecksum {
+			if err := checkResultChecksum(e, resps[i].Checksum); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return resps, nil
+}
+
+// checkResultChecksum verifies the checksum the server computed over the
+// serialized result against the raw result bytes we received
+func checkResultChecksum(raw json.RawMessage, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	var body struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return fmt.Errorf("checksum: %w", err)
+	}
+	algo, _, _ := strings.Cut(checksum, ":")
+	var got string
+	switch algo {
+	case "crc32":
+		got = fmt.Sprintf("crc32:%08x", crc32.ChecksumIEEE(body.Result))
+	case "sha256":
+		sum := sha256.Sum256(body.Result)
+		got = "sha256:" + hex.EncodeToString(sum[:])
+	default:
+		return fmt.Errorf("checksum: unsupported algorithm %q", algo)
+	}
+	if got != checksum {
+		return fmt.Errorf("checksum mismatch: response says %s, computed %s", checksum, got)
+	}
+	return nil
+}
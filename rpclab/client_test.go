@@ -0,0 +1,578 @@
+package rpclab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientCallFramings(t *testing.T) {
+	for _, framing := range []string{"json", "length"} {
+		t.Run(framing, func(t *testing.T) {
+			_, addr := startServer(t, func(cfg *Config) { cfg.Framing = framing })
+			c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second, PoolSize: 1, Framing: framing})
+			defer c.Close()
+			// the second call reuses the pooled connection
+			for i := 0; i < 2; i++ {
+				resp, err := c.Call("add", map[string]interface{}{"a": i, "b": 10})
+				if err != nil {
+					t.Fatalf("call %d: %v", i, err)
+				}
+				if got, want := fmt.Sprint(resp.Result), fmt.Sprint(i+10); got != want {
+					t.Errorf("call %d: result = %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestClientApplicationError(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+	resp, err := c.Call("divide", map[string]interface{}{"a": 1, "b": 0})
+	if !errors.Is(err, ErrServerApplication) {
+		t.Fatalf("err = %v, want ErrServerApplication", err)
+	}
+	if Retryable(err) {
+		t.Error("application error reported as retryable")
+	}
+	if resp == nil || resp.Code != ErrBadParams {
+		t.Errorf("resp = %+v, want code %s", resp, ErrBadParams)
+	}
+}
+
+func TestClientDoBatch(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+	resps, err := c.DoBatch([]Request{
+		{RequestID: "1", Method: "add", Params: map[string]interface{}{"a": 1, "b": 2}},
+		{RequestID: "2", Method: "reverse_string", Params: map[string]interface{}{"s": "ab"}},
+		{RequestID: "3", Method: "no_such_method"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ id, result, code string }{
+		{"1", "3", ""},
+		{"2", "ba", ""},
+		{"3", "<nil>", ErrUnknownMethod},
+	}
+	if len(resps) != len(want) {
+		t.Fatalf("got %d responses, want %d", len(resps), len(want))
+	}
+	for i, w := range want {
+		r := resps[i]
+		if r.RequestID != w.id || fmt.Sprint(r.Result) != w.result || r.Code != w.code {
+			t.Errorf("response %d = {%s %v %s}, want {%s %s %s}", i, r.RequestID, r.Result, r.Code, w.id, w.result, w.code)
+		}
+	}
+}
+
+func TestClientStream(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+	var got []string
+	err := c.Stream(&Request{RequestID: "s", Method: "countdown", Params: map[string]interface{}{"from": 3}}, func(r *Response) error {
+		got = append(got, fmt.Sprint(r.Result))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[3 2 1]" {
+		t.Errorf("stream = %v, want [3 2 1]", got)
+	}
+}
+
+func TestClientDialError(t *testing.T) {
+	// grab a free port and release it so nothing is listening there
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	c := NewClient(addr, ClientConfig{Timeout: time.Second})
+	if _, err := c.Call("ping", nil); err == nil || !Retryable(err) {
+		t.Errorf("err = %v, want a retryable dial error", err)
+	}
+}
+
+func TestClientIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	s, err := NewServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+	defer func() {
+		s.Shutdown()
+		<-done
+	}()
+	addr := ln.Addr().String()
+	if !strings.HasPrefix(addr, "[::1]:") {
+		t.Fatalf("listening on %s", addr)
+	}
+	c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+	defer c.Close()
+	if _, err := c.Call("ping", nil); err != nil {
+		t.Errorf("ping over %s: %v", addr, err)
+	}
+}
+
+func TestBreakerStates(t *testing.T) {
+	_, addr := startServer(t, nil)
+	const cooldown = 100 * time.Millisecond
+	var failing atomic.Bool
+	var dials atomic.Int64
+	c := NewClient(addr, ClientConfig{
+		Timeout: 5 * time.Second,
+		Breaker: NewBreaker(2, cooldown),
+		Dial: func(network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			if failing.Load() {
+				return nil, errors.New("connection refused")
+			}
+			return net.Dial(network, addr)
+		},
+	})
+	steps := []struct {
+		name    string
+		fail    bool // the fake dialer fails
+		wait    bool // sleep past the cooldown first
+		method  string
+		err     string // "" ok, "dial", "open" (ErrCircuitOpen) or "app"
+		dialled bool
+	}{
+		{"closed: first failure", true, false, "ping", "dial", true},
+		{"closed: threshold reached", true, false, "ping", "dial", true},
+		{"open: fails fast", true, false, "ping", "open", false},
+		{"half-open: failed probe", true, true, "ping", "dial", true},
+		{"reopened: fails fast", true, false, "ping", "open", false},
+		{"half-open: probe succeeds", false, true, "ping", "", true},
+		{"closed again", false, false, "ping", "", true},
+		{"closed: application errors count as success", false, false, "divide", "app", true},
+		{"closed: one transport failure is below the threshold", true, false, "ping", "dial", true},
+		{"closed: still", false, false, "ping", "", true},
+	}
+	for _, st := range steps {
+		if st.wait {
+			time.Sleep(cooldown + 20*time.Millisecond)
+		}
+		failing.Store(st.fail)
+		before := dials.Load()
+		_, err := c.Call(st.method, map[string]interface{}{"a": 1, "b": 0})
+		var got string
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrCircuitOpen):
+			got = "open"
+		case errors.Is(err, ErrServerApplication):
+			got = "app"
+		default:
+			got = "dial"
+		}
+		if got != st.err {
+			t.Fatalf("%s: err = %v, want %q", st.name, err, st.err)
+		}
+		if dialled := dials.Load() > before; dialled != st.dialled {
+			t.Fatalf("%s: dialled = %t, want %t", st.name, dialled, st.dialled)
+		}
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	b := NewBreaker(1, 0)
+	b.record(errors.New("boom"))
+	if err := b.allow(); err != nil {
+		t.Fatalf("probe not allowed after the cooldown: %v", err)
+	}
+	// while the probe is in flight everyone else still fails fast
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second caller during the probe: %v, want ErrCircuitOpen", err)
+	}
+	b.record(nil)
+	if err := b.allow(); err != nil {
+		t.Errorf("breaker not closed after a good probe: %v", err)
+	}
+	if NewBreaker(0, time.Second) != nil {
+		t.Error("threshold 0 should disable the breaker")
+	}
+}
+
+// flakyServer answers pings, except that on its first connection it reads
+// the second request and then, per mode, closes ("drop"), ignores it
+// ("stall") or answers it after a goodbye frame and closes ("goodbye"). It
+// returns its address and a count of accepted connections.
+func flakyServer(t *testing.T, mode string) (string, *atomic.Int64) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := &atomic.Int64{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			n := accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				codec := &jsonCodec{in: newMessageReader(conn, 0, errRequestTooLarge), w: conn, enc: json.NewEncoder(conn)}
+				for served := 0; ; served++ {
+					msg, err := codec.readMessage()
+					if err != nil {
+						return
+					}
+					var req Request
+					DecodeJSON(msg, &req)
+					if n == 1 && served == 1 {
+						switch mode {
+						case "stall":
+							io.Copy(io.Discard, conn)
+						case "goodbye":
+							codec.writeMessage(&Response{Status: "GOODBYE", Close: true})
+							codec.writeMessage(&Response{RequestID: req.RequestID, Status: "OK", Result: "pong", Close: true})
+						}
+						return
+					}
+					codec.writeMessage(&Response{RequestID: req.RequestID, Status: "OK", Result: "pong"})
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), accepted
+}
+
+func TestServerClosedMidResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		reply  string // written before the server closes
+		closed bool   // want ErrServerClosed
+	}{
+		{"nothing sent", "", true},
+		{"partial response", `{"request_id":"r1","sta`, true},
+		{"garbage", "not json\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				// like crash: read the request, then exit mid-write
+				if _, _, err := newMessageReader(conn, 0, errRequestTooLarge).next(); err != nil {
+					return
+				}
+				io.WriteString(conn, tt.reply)
+			}()
+			c := NewClient(ln.Addr().String(), ClientConfig{Timeout: 5 * time.Second})
+			defer c.Close()
+			_, err = c.Call("crash", nil)
+			if err == nil {
+				t.Fatal("call succeeded")
+			}
+			if errors.Is(err, ErrServerClosed) != tt.closed {
+				t.Fatalf("err = %v, want ErrServerClosed %t", err, tt.closed)
+			}
+			if tt.closed && (!Retryable(err) || !strings.Contains(err.Error(), "server closed connection without a complete response")) {
+				t.Errorf("err = %v (retryable %t), want a retryable server-closed error", err, Retryable(err))
+			}
+		})
+	}
+}
+
+func TestReconnectOnError(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		reconnect bool
+		wantErr   bool
+		dials     int64
+	}{
+		{"dropped, reconnects", "drop", true, false, 2},
+		{"dropped, policy off", "drop", false, true, 1},
+		// a timeout may mean the server is still working on the call
+		{"stalled, no reconnect", "stall", true, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, accepted := flakyServer(t, tt.mode)
+			c := NewClient(addr, ClientConfig{Timeout: 300 * time.Millisecond, PoolSize: 1, ReconnectOnError: tt.reconnect})
+			defer c.Close()
+			if _, err := c.Call("ping", nil); err != nil {
+				t.Fatalf("first call: %v", err)
+			}
+			// the pooled connection still looks fine; the server drops it
+			// only once the next request is on it
+			resp, err := c.Call("ping", nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("second call: err = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && fmt.Sprint(resp.Result) != "pong" {
+				t.Errorf("second call: %+v", resp)
+			}
+			if got := accepted.Load(); got != tt.dials {
+				t.Errorf("server accepted %d connections, want %d", got, tt.dials)
+			}
+		})
+	}
+}
+
+func TestRetryableOn(t *testing.T) {
+	codes := []string{ErrRateLimited, ErrDeadlineExceeded}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"transport failure", errors.New("connection reset"), true},
+		{"listed code", &ServerError{Code: ErrRateLimited}, true},
+		{"other listed code", fmt.Errorf("call: %w", &ServerError{Code: ErrDeadlineExceeded}), true},
+		{"unlisted code", &ServerError{Code: ErrUnavailable}, false},
+		{"no code", &ServerError{Message: "boom"}, false},
+		{"breaker open", ErrCircuitOpen, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RetryableOn(tt.err, codes); got != tt.want {
+				t.Errorf("RetryableOn(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfterHints(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		method    string
+		code      string
+		max       time.Duration
+	}{
+		// the first call takes the only token, which comes back after 200ms
+		{"rate limited", func(c *Config) { c.Rate, c.Burst = 5, 1 }, "add", ErrRateLimited, 200 * time.Millisecond},
+		{"warming up", func(c *Config) { c.Warmup = 2 * time.Second }, "get_time", ErrNotReady, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, tt.configure)
+			c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+			defer c.Close()
+			var err error
+			for i := 0; i < 2 && err == nil; i++ {
+				_, err = c.Call(tt.method, map[string]interface{}{"a": 1, "b": 2})
+			}
+			var se *ServerError
+			if !errors.As(err, &se) || se.Code != tt.code {
+				t.Fatalf("err = %v, want code %s", err, tt.code)
+			}
+			if after := RetryAfter(err); after <= 0 || after > tt.max {
+				t.Errorf("retry after %v, want up to %v", after, tt.max)
+			}
+		})
+	}
+}
+
+func TestPoolConnTTL(t *testing.T) {
+	_, addr := startServer(t, nil)
+	const ttl = 150 * time.Millisecond
+	var dials atomic.Int64
+	c := NewClient(addr, ClientConfig{
+		Timeout:     5 * time.Second,
+		PoolSize:    1,
+		PoolConnTTL: ttl,
+		Dial: func(network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return net.Dial(network, addr)
+		},
+	})
+	defer c.Close()
+	idle := func() int {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.idle)
+	}
+	steps := []struct {
+		name  string
+		wait  time.Duration
+		dials int64
+	}{
+		{"first call dials", 0, 1},
+		{"young connection reused", 0, 1},
+		{"old connection replaced", ttl + 50*time.Millisecond, 2},
+		{"replacement reused", 0, 2},
+	}
+	for _, st := range steps {
+		time.Sleep(st.wait)
+		if _, err := c.Call("ping", nil); err != nil {
+			t.Fatalf("%s: %v", st.name, err)
+		}
+		if got := dials.Load(); got != st.dials {
+			t.Fatalf("%s: %d dials, want %d", st.name, got, st.dials)
+		}
+	}
+	// the sweep prunes the idle connection without another call
+	if idle() != 1 {
+		t.Fatalf("%d idle connections, want 1", idle())
+	}
+	waitFor(t, func() bool { return idle() == 0 })
+}
+
+func TestClientLocalAddr(t *testing.T) {
+	_, addr := startServer(t, nil)
+	local := freeAddr(t)
+	tests := []struct {
+		name  string
+		local *net.TCPAddr
+		want  string // the source address the server sees, "" for any port
+	}{
+		{"ip and port", local, local.String()},
+		{"ip only", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second, LocalAddr: tt.local})
+			defer c.Close()
+			resp, err := c.Call("echo", map[string]interface{}{"include_meta": true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, _ := resp.Result.(map[string]interface{})
+			remote := fmt.Sprint(m["remote"])
+			host, _, err := net.SplitHostPort(remote)
+			if err != nil || host != "127.0.0.1" {
+				t.Fatalf("server saw %s, want a 127.0.0.1 source", remote)
+			}
+			if tt.want != "" && remote != tt.want {
+				t.Errorf("server saw %s, want %s", remote, tt.want)
+			}
+		})
+	}
+}
+
+// freeAddr returns a loopback TCP address nothing is bound to
+func freeAddr(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestCallReadsPastGoodbye(t *testing.T) {
+	addr, accepted := flakyServer(t, "goodbye")
+	c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second, PoolSize: 1})
+	defer c.Close()
+	for i := 1; i <= 3; i++ {
+		resp, err := c.Call("ping", nil)
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		if resp.Status != "OK" {
+			t.Fatalf("call %d: status %s, want OK", i, resp.Status)
+		}
+	}
+	// the response after the goodbye carried close, so the third call redialed
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("accepted %d connections, want 2", n)
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	tests := []struct {
+		name    string
+		algo    string
+		corrupt bool
+	}{
+		{"crc32 intact", "crc32", false},
+		{"crc32 corrupted", "crc32", true},
+		{"sha256 intact", "sha256", false},
+		{"sha256 corrupted", "sha256", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				codec := &jsonCodec{in: newMessageReader(conn, 0, errRequestTooLarge), w: conn, enc: json.NewEncoder(conn)}
+				msg, err := codec.readMessage()
+				if err != nil {
+					return
+				}
+				var req Request
+				DecodeJSON(msg, &req)
+				// the checksum covers "pong", as the server computed it
+				// before a byte flipped on the way
+				result := `"pong"`
+				if tt.corrupt {
+					result = `"ponk"`
+				}
+				fmt.Fprintf(conn, `{"request_id":%q,"result":%s,"status":"OK","checksum":%q}`+"\n", req.RequestID, result, resultChecksum(tt.algo, []byte(`"pong"`)))
+			}()
+
+			c := NewClient(ln.Addr().String(), ClientConfig{Timeout: 5 * time.Second, VerifyChecksum: true})
+			defer c.Close()
+			_, err = c.Call("ping", nil)
+			if !tt.corrupt {
+				if err != nil {
+					t.Fatalf("intact response rejected: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("corrupted response accepted")
+			}
+			if !strings.Contains(err.Error(), "checksum mismatch") || !Retryable(err) {
+				t.Errorf("err = %v (retryable %t), want a retryable checksum mismatch", err, Retryable(err))
+			}
+		})
+	}
+}
+
+func TestChecksumRoundTrip(t *testing.T) {
+	for _, algo := range []string{"crc32", "sha256"} {
+		t.Run(algo, func(t *testing.T) {
+			_, addr := startServer(t, func(cfg *Config) { cfg.ResponseChecksum = algo })
+			c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second, VerifyChecksum: true})
+			defer c.Close()
+			resp, err := c.Call("echo", map[string]interface{}{"s": "héllo", "n": 1.5})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(resp.Checksum, algo+":") {
+				t.Errorf("checksum = %q, want %s", resp.Checksum, algo)
+			}
+		})
+	}
+}
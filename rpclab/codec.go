@@ -0,0 +1,343 @@
+package rpclab
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// wireCodec reads and writes whole JSON messages in the configured framing
+type wireCodec interface {
+	readMessage() ([]byte, error)
+	writeMessage(v interface{}) error
+}
+
+// jsonCodec relies on JSON object boundaries to separate messages. Clients
+// running with -compress also send large messages compressed; once a peer
+// has sent one, large messages to it are compressed too.
+type jsonCodec struct {
+	in         *messageReader
+	w          io.Writer
+	enc        *json.Encoder
+	lim        *messageLimiter // nil = unlimited
+	compressed bool
+}
+
+func (c *jsonCodec) readMessage() ([]byte, error) {
+	if c.lim != nil {
+		c.lim.reset()
+	}
+	msg, compressed, err := c.in.next()
+	if compressed {
+		c.compressed = true
+	}
+	return msg, err
+}
+
+func (c *jsonCodec) writeMessage(v interface{}) error {
+	if !c.compressed {
+		return c.enc.Encode(v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) < CompressThreshold {
+		_, err = c.w.Write(append(b, '\n'))
+		return err
+	}
+	return writeCompressed(c.w, b)
+}
+
+// a compressed message is compressFlag, then in json framing a 4-byte
+// big-endian length, then that many bytes of gzip. In length framing the
+// frame payload is compressFlag followed by the gzip bytes.
+const compressFlag byte = 0x01
+
+// messages smaller than this are never compressed
+const CompressThreshold = 1 << 10
+
+// messageReader splits a json-framed stream into JSON values and compressed
+// messages. json.Decoder reads ahead, so a compressed message may already
+// sit in its buffer; the decoder is then rebuilt behind it.
+type messageReader struct {
+	base    io.Reader
+	br      *bufio.Reader
+	dec     *json.Decoder
+	max     int64
+	tooLong error
+}
+
+func newMessageReader(r io.Reader, max int64, tooLong error) *messageReader {
+	br := bufio.NewReader(r)
+	return &messageReader{base: r, br: br, dec: json.NewDecoder(br), max: max, tooLong: tooLong}
+}
+
+// next returns the next message, decompressed, and whether it was compressed
+func (m *messageReader) next() ([]byte, bool, error) {
+	buffered, _ := io.ReadAll(m.dec.Buffered())
+	i := bytes.IndexFunc(buffered, notJSONSpace)
+	switch {
+	case i >= 0 && buffered[i] != compressFlag:
+		return m.decode()
+	case i >= 0:
+		pending, _ := m.br.Peek(m.br.Buffered())
+		rest := append(buffered[i:len(buffered):len(buffered)], pending...)
+		m.br = bufio.NewReader(io.MultiReader(bytes.NewReader(rest), m.base))
+	default:
+		// only whitespace is buffered, so it's safe to skip it in br
+		for {
+			p, err := m.br.Peek(1)
+			if err != nil {
+				return nil, false, err
+			}
+			if !isJSONSpace(rune(p[0])) {
+				break
+			}
+			m.br.Discard(1)
+		}
+		if p, _ := m.br.Peek(1); p[0] != compressFlag {
+			return m.decode()
+		}
+	}
+	m.dec = json.NewDecoder(m.br)
+	msg, err := readCompressed(m.br, m.max, m.tooLong)
+	return msg, true, err
+}
+
+// pending reports whether anything but whitespace has been read past the
+// last message
+func (m *messageReader) pending() bool {
+	buffered, _ := io.ReadAll(m.dec.Buffered())
+	pending, _ := m.br.Peek(m.br.Buffered())
+	return bytes.IndexFunc(buffered, notJSONSpace) >= 0 || bytes.IndexFunc(pending, notJSONSpace) >= 0
+}
+
+func (m *messageReader) decode() ([]byte, bool, error) {
+	var raw json.RawMessage
+	if err := m.dec.Decode(&raw); err != nil {
+		return nil, false, err
+	}
+	return raw, false, nil
+}
+
+func isJSONSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\r' || r == '\n'
+}
+
+func notJSONSpace(r rune) bool { return !isJSONSpace(r) }
+
+// readCompressed reads one length-prefixed compressed message from r
+func readCompressed(r io.Reader, max int64, tooLong error) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	n := int64(binary.BigEndian.Uint32(hdr[1:]))
+	if max > 0 && n > max {
+		return nil, fmt.Errorf("%w: compressed message of %d bytes", tooLong, n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return gunzipMessage(b, max, tooLong)
+}
+
+// writeCompressed writes b as a length-prefixed compressed message
+func writeCompressed(w io.Writer, b []byte) error {
+	gz := gzipMessage(b)
+	msg := make([]byte, 5, 5+len(gz))
+	msg[0] = compressFlag
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(gz)))
+	_, err := w.Write(append(msg, gz...))
+	return err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func gzipMessage(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// gunzipMessage decompresses b, failing with tooLong past max bytes
+func gunzipMessage(b []byte, max int64, tooLong error) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed message: %w", err)
+	}
+	var r io.Reader = zr
+	if max > 0 {
+		r = io.LimitReader(zr, max+1)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed message: %w", err)
+	}
+	if max > 0 && int64(len(out)) > max {
+		return nil, fmt.Errorf("%w: decompresses to more than %d bytes", tooLong, max)
+	}
+	return out, nil
+}
+
+var errRequestTooLarge = errors.New("request too large")
+
+// messageLimiter fails reads once the current message has pulled more than
+// max bytes from r, so the JSON decoder never buffers an unbounded value.
+// Bytes the decoder read ahead before reset aren't counted.
+type messageLimiter struct {
+	r    io.Reader
+	max  int64
+	left int64
+}
+
+func (l *messageLimiter) reset() { l.left = l.max }
+
+func (l *messageLimiter) Read(p []byte) (int, error) {
+	if l.max <= 0 {
+		return l.r.Read(p)
+	}
+	if l.left <= 0 {
+		return 0, fmt.Errorf("%w: exceeds %d bytes", errRequestTooLarge, l.max)
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+// lengthCodec frames each message with a 4-byte big-endian length prefix
+type lengthCodec struct {
+	r          io.Reader
+	w          io.Writer
+	max        int
+	compressed bool // as in jsonCodec
+}
+
+func (c *lengthCodec) readMessage() ([]byte, error) {
+	b, err := readFrame(c.r, c.max)
+	if err != nil || len(b) == 0 || b[0] != compressFlag {
+		return b, err
+	}
+	c.compressed = true
+	return gunzipMessage(b[1:], int64(c.max), errFrameTooLarge)
+}
+
+func (c *lengthCodec) writeMessage(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if c.compressed && len(b) >= CompressThreshold {
+		b = append([]byte{compressFlag}, gzipMessage(b)...)
+	}
+	if len(b) > c.max {
+		return fmt.Errorf("%w: %d bytes exceeds %d", errFrameTooLarge, len(b), c.max)
+	}
+	return writeFrame(c.w, b)
+}
+
+// readFrame reads one length-prefixed frame. An oversized frame's payload is
+// discarded so the next frame can still be read.
+func readFrame(r io.Reader, max int) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if int64(n) > int64(max) {
+		if _, err := io.CopyN(io.Discard, r, int64(n)); err != nil {
+			return nil, fmt.Errorf("truncated frame: %w", err)
+		}
+		return nil, fmt.Errorf("%w: %d bytes exceeds %d", errFrameTooLarge, n, max)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("truncated frame: %w", err)
+	}
+	return b, nil
+}
+
+// writeFrame writes b with its length prefix in a single write
+func writeFrame(w io.Writer, b []byte) error {
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// largest datagram read or sent in udp mode
+const maxDatagramSize = 64 << 10
+
+// packetCodec writes replies to the sender of one datagram
+type packetCodec struct {
+	pc   net.PacketConn
+	addr net.Addr
+}
+
+func (c *packetCodec) readMessage() ([]byte, error) {
+	return nil, io.EOF
+}
+
+func (c *packetCodec) writeMessage(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxDatagramSize {
+		return fmt.Errorf("%w: %d bytes exceeds %d", errFrameTooLarge, len(b), maxDatagramSize)
+	}
+	_, err = c.pc.WriteTo(b, c.addr)
+	return err
+}
+
+var errResponseTooLarge = errors.New("response too large")
+
+// datagramCodec sends and receives each message as a single UDP datagram
+type datagramCodec struct {
+	conn net.Conn
+}
+
+func (c *datagramCodec) readMessage() ([]byte, error) {
+	buf := make([]byte, maxDatagramSize)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (c *datagramCodec) writeMessage(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxDatagramSize {
+		return fmt.Errorf("request of %d bytes is too large for a datagram", len(b))
+	}
+	_, err = c.conn.Write(b)
+	return err
+}
@@ -0,0 +1,171 @@
+package rpclab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	jsonrpcParseError     = -32700
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+	jsonrpcInternalError  = -32603
+	jsonrpcServerError    = -32000 // any other native error code; see error.data.code
+)
+
+// jsonrpcInvalid is the internal method malformed JSON-RPC requests are
+// rewritten to, so they are answered with their id like any other error.
+// Names starting with "rpc." are reserved by the spec.
+const jsonrpcInvalid = "rpc.invalid"
+
+type jsonrpcRequest struct {
+	JSONRPC   string          `json:"jsonrpc"`
+	Method    string          `json:"method"`
+	Params    json.RawMessage `json:"params"`
+	ID        json.RawMessage `json:"id"`
+	AuthToken string          `json:"auth_token"` // extension member for -auth-token
+}
+
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonrpcError struct {
+	Code    int               `json:"code"`
+	Message string            `json:"message"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+// jsonrpcCodec translates between JSON-RPC 2.0 on the wire and the native
+// request/response shapes. The native request id carries the raw JSON id, so
+// numeric and string ids come back exactly as sent.
+type jsonrpcCodec struct {
+	wireCodec
+	clock Clock // stamps the ids given to notifications
+}
+
+func (c *jsonrpcCodec) readMessage() ([]byte, error) {
+	msg, err := c.wireCodec.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	if !isBatch(msg) {
+		req, ok := fromJSONRPC(msg, c.clock)
+		if !ok {
+			// not JSON at all: the native decode reports it as a parse error
+			return msg, nil
+		}
+		return json.Marshal(req)
+	}
+	var elems []json.RawMessage
+	if err := json.Unmarshal(msg, &elems); err != nil {
+		return msg, nil
+	}
+	reqs := make([]*Request, len(elems))
+	for i, elem := range elems {
+		reqs[i], _ = fromJSONRPC(elem, c.clock)
+	}
+	return json.Marshal(reqs)
+}
+
+func (c *jsonrpcCodec) writeMessage(v interface{}) error {
+	switch t := v.(type) {
+	case Response:
+		return c.wireCodec.writeMessage(toJSONRPC(&t))
+	case *Response:
+		return c.wireCodec.writeMessage(toJSONRPC(t))
+	case []*Response:
+		out := make([]*jsonrpcResponse, len(t))
+		for i, r := range t {
+			out[i] = toJSONRPC(r)
+		}
+		return c.wireCodec.writeMessage(out)
+	}
+	return c.wireCodec.writeMessage(v)
+}
+
+// fromJSONRPC converts one JSON-RPC request. Valid JSON that isn't a valid
+// request becomes a call to jsonrpcInvalid; ok is false only for bytes that
+// aren't JSON.
+func fromJSONRPC(b []byte, clock Clock) (req *Request, ok bool) {
+	if !json.Valid(b) {
+		return nil, false
+	}
+	invalid := func(id json.RawMessage, reason string) *Request {
+		if len(id) == 0 {
+			id = json.RawMessage("null")
+		}
+		return &Request{RequestID: string(id), Method: jsonrpcInvalid, Params: map[string]interface{}{"reason": reason}}
+	}
+	var in jsonrpcRequest
+	if err := json.Unmarshal(b, &in); err != nil {
+		return invalid(nil, "invalid request object"), true
+	}
+	if in.JSONRPC != "2.0" {
+		return invalid(in.ID, `jsonrpc must be "2.0"`), true
+	}
+	if in.Method == "" {
+		return invalid(in.ID, "missing method"), true
+	}
+	req = &Request{RequestID: string(in.ID), Method: in.Method, AuthToken: in.AuthToken}
+	if len(in.ID) == 0 {
+		// a notification: run it but never answer
+		id, err := newULID(clock.Now())
+		if err != nil {
+			return invalid(nil, err.Error()), true
+		}
+		req.RequestID = "notification-" + id
+		req.Oneway = true
+	}
+	if p := bytes.TrimSpace(in.Params); len(p) > 0 && !bytes.Equal(p, []byte("null")) {
+		if p[0] != '{' || DecodeJSON(p, &req.Params) != nil {
+			return invalid(in.ID, "params must be an object; positional params are not supported"), true
+		}
+	}
+	return req, true
+}
+
+func toJSONRPC(r *Response) *jsonrpcResponse {
+	out := &jsonrpcResponse{JSONRPC: "2.0"}
+	if id := json.RawMessage(r.RequestID); json.Valid(id) {
+		out.ID = id
+	}
+	if r.Status == "OK" {
+		b, err := json.Marshal(r.Result)
+		if err != nil {
+			b = []byte("null")
+		}
+		out.Result = b
+		return out
+	}
+	e := &jsonrpcError{Code: jsonrpcServerError, Message: r.Error}
+	if r.Code != "" {
+		e.Data = map[string]string{"code": r.Code}
+	}
+	switch r.Code {
+	case ErrBadRequest:
+		e.Code = jsonrpcInvalidRequest
+		if r.Error == "invalid json" {
+			e.Code = jsonrpcParseError
+		}
+	case ErrUnknownMethod:
+		e.Code = jsonrpcMethodNotFound
+	case ErrBadParams:
+		e.Code = jsonrpcInvalidParams
+	case ErrInternal:
+		e.Code = jsonrpcInternalError
+	}
+	out.Error = e
+	return out
+}
+
+func handleInvalidJSONRPC(_ context.Context, params map[string]interface{}) (interface{}, error) {
+	reason, _ := params["reason"].(string)
+	return nil, newMethodError(ErrBadRequest, reason)
+}
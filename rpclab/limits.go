@@ -0,0 +1,567 @@
+package rpclab
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the banlist file is checked for changes
+const banlistReloadInterval = 5 * time.Second
+
+// banlist is a hot-reloadable set of banned IPs and CIDR ranges
+type banlist struct {
+	path    string
+	mu      sync.RWMutex
+	nets    []*net.IPNet
+	modTime time.Time
+}
+
+func loadBanlist(path string) (*banlist, error) {
+	b := &banlist{path: path}
+	if err := b.reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// reload re-reads the file; on error the previous list stays in effect
+func (b *banlist) reload() error {
+	fi, err := os.Stat(b.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return err
+	}
+	var nets []*net.IPNet
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.Contains(line, "/") {
+			if ip := net.ParseIP(line); ip != nil && ip.To4() != nil {
+				line += "/32"
+			} else {
+				line += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(line)
+		if err != nil {
+			return fmt.Errorf("%s line %d: %v", b.path, i+1, err)
+		}
+		nets = append(nets, n)
+	}
+	b.mu.Lock()
+	b.nets = nets
+	b.modTime = fi.ModTime()
+	b.mu.Unlock()
+	return nil
+}
+
+// watch reloads the banlist whenever the file's modification time changes
+func (b *banlist) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		fi, err := os.Stat(b.path)
+		if err != nil {
+			log.Printf("banlist: %v", err)
+			continue
+		}
+		b.mu.RLock()
+		changed := !fi.ModTime().Equal(b.modTime)
+		b.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := b.reload(); err != nil {
+			log.Printf("banlist reload failed, keeping previous list: %v", err)
+			continue
+		}
+		log.Printf("banlist reloaded from %s", b.path)
+	}
+}
+
+func (b *banlist) banned(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, n := range b.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipConnLimiter caps concurrent connections per client IP
+type ipConnLimiter struct {
+	max   int
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func newIPConnLimiter(max int) *ipConnLimiter {
+	return &ipConnLimiter{max: max, conns: map[string]int{}}
+}
+
+func (l *ipConnLimiter) acquire(ip net.IP) bool {
+	if l.max <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip.String()] >= l.max {
+		return false
+	}
+	l.conns[ip.String()]++
+	return true
+}
+
+func (l *ipConnLimiter) release(ip net.IP) {
+	if l.max <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip.String()]--; l.conns[ip.String()] <= 0 {
+		delete(l.conns, ip.String())
+	}
+}
+
+// connSemaphore caps how many connections are served at once. A full
+// semaphore either rejects new connections or lets them wait up to queueWait.
+type connSemaphore struct {
+	slots     chan struct{}
+	queueWait time.Duration
+}
+
+func newConnSemaphore(max int, queueWait time.Duration) *connSemaphore {
+	s := &connSemaphore{queueWait: queueWait}
+	if max > 0 {
+		s.slots = make(chan struct{}, max)
+	}
+	return s
+}
+
+func (s *connSemaphore) acquire() bool {
+	if s.slots == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if s.queueWait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(s.queueWait)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (s *connSemaphore) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+func (s *connSemaphore) max() int {
+	return cap(s.slots)
+}
+
+// ipRateLimiter keeps a token bucket per client IP: each request takes a
+// token, and tokens refill at rate per second up to burst
+type ipRateLimiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newIPRateLimiter(rate float64, burst int) *ipRateLimiter {
+	b := float64(burst)
+	if burst <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &ipRateLimiter{rate: rate, burst: b, buckets: map[string]*tokenBucket{}}
+}
+
+// allow takes a token from ip's bucket; when it is empty it reports how long
+// until the next token
+func (l *ipRateLimiter) allow(ip net.IP) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[ip.String()]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip.String()] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweepLoop periodically drops buckets of idle IPs. A bucket untouched long
+// enough to refill completely is the same as a new one, so nothing is lost.
+func (l *ipRateLimiter) sweepLoop(every time.Duration) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for range time.Tick(every) {
+		now := time.Now()
+		l.mu.Lock()
+		for ip, b := range l.buckets {
+			if now.Sub(b.last) >= refill {
+				delete(l.buckets, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// remoteIP extracts the peer IP of a connection
+func remoteIP(conn net.Conn) net.IP {
+	if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// acceptThrottle spaces out Accept calls so at most rate connections are
+// accepted per second; the rest wait in the kernel backlog
+type acceptThrottle struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newAcceptThrottle(rate float64) *acceptThrottle {
+	if rate <= 0 {
+		return &acceptThrottle{}
+	}
+	return &acceptThrottle{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+func (t *acceptThrottle) wait() {
+	if t.interval == 0 {
+		return
+	}
+	now := time.Now()
+	if t.next.After(now) {
+		time.Sleep(t.next.Sub(now))
+		now = t.next
+	}
+	t.next = now.Add(t.interval)
+}
+
+// gzip streams start with these two magic bytes; a JSON request never does
+var gzipMagic = []byte{0x1f, 0x8b}
+
+var errDecompressionLimit = errors.New("decompressed request exceeds limits")
+
+// requestReader returns a reader over the request body, transparently
+// decompressing it when the client sent a gzip stream
+func (s *Server) requestReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil || magic[0] != gzipMagic[0] || magic[1] != gzipMagic[1] {
+		// not gzip (or too short to tell): let the JSON decoder deal with it
+		return br, nil
+	}
+	compressed := &countingReader{r: br}
+	gz, err := gzip.NewReader(compressed)
+	if err != nil {
+		return nil, err
+	}
+	return &bombGuard{r: gz, compressed: compressed, maxBytes: s.cfg.MaxDecompressedBytes, maxRatio: s.cfg.MaxCompressionRatio}, nil
+}
+
+// countingReader counts bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// bombGuard stops reading decompressed data once it exceeds the configured
+// size or ratio to the compressed bytes consumed. The error is sticky so
+// callers that keep reading never see more data.
+type bombGuard struct {
+	r          io.Reader
+	compressed *countingReader
+	maxBytes   int64 // -max-decompressed-bytes
+	maxRatio   int64 // -max-compression-ratio
+	n          int64
+	err        error
+}
+
+// ratios are only enforced past this size so tiny, highly repetitive
+// requests aren't rejected
+const minRatioCheckBytes = 64 << 10
+
+func (g *bombGuard) Read(p []byte) (int, error) {
+	if g.err != nil {
+		return 0, g.err
+	}
+	n, err := g.r.Read(p)
+	g.n += int64(n)
+	if g.n > g.maxBytes {
+		g.err = fmt.Errorf("%w: more than %d bytes", errDecompressionLimit, g.maxBytes)
+		return 0, g.err
+	}
+	if g.n > minRatioCheckBytes && g.compressed.n > 0 && g.n/g.compressed.n > g.maxRatio {
+		g.err = fmt.Errorf("%w: compression ratio above %d", errDecompressionLimit, g.maxRatio)
+		return 0, g.err
+	}
+	return n, err
+}
+
+// rateLimitedWriter paces writes to roughly rate bytes per second by writing
+// in small chunks and sleeping between them
+type rateLimitedWriter struct {
+	w    io.Writer
+	rate int
+}
+
+func newRateLimitedWriter(w io.Writer, rate int) io.Writer {
+	if rate <= 0 {
+		return w
+	}
+	return &rateLimitedWriter{w: w, rate: rate}
+}
+
+func (rw *rateLimitedWriter) Write(p []byte) (int, error) {
+	// ~10 chunks per second keeps the pacing smooth without tiny writes
+	chunk := rw.rate / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+	written := 0
+	for written < len(p) {
+		end := written + chunk
+		if end > len(p) {
+			end = len(p)
+		}
+		n, err := rw.w.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(rw.rate))
+	}
+	return written, nil
+}
+
+// workerPool is a fixed set of goroutines processing queued requests
+type workerPool struct {
+	jobs    chan *poolJob
+	run     func(ctx context.Context, req *Request) *Response
+	maxWait time.Duration // how long a job may wait for a free worker (0 = forever)
+}
+
+type poolJob struct {
+	ctx    context.Context
+	req    *Request
+	result chan handlerResult
+}
+
+func newWorkerPool(workers int, maxWait time.Duration, run func(ctx context.Context, req *Request) *Response) *workerPool {
+	p := &workerPool{jobs: make(chan *poolJob), run: run, maxWait: maxWait}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *workerPool) worker() {
+	for j := range p.jobs {
+		j.result <- callGuarded(func() *Response { return p.run(j.ctx, j.req) })
+	}
+}
+
+// submit blocks until a worker is free and has processed req, returning the
+// response and how long the job waited for a worker. If no worker picks the
+// job up within maxWait, or before the request deadline, it is dropped
+// without being run.
+func (p *workerPool) submit(ctx context.Context, req *Request) (*Response, time.Duration) {
+	j := &poolJob{ctx: ctx, req: req, result: make(chan handlerResult, 1)}
+	enqueued := time.Now()
+	var queueTimeout <-chan time.Time
+	if p.maxWait > 0 {
+		timer := time.NewTimer(p.maxWait)
+		defer timer.Stop()
+		queueTimeout = timer.C
+	}
+	select {
+	case p.jobs <- j:
+		waited := time.Since(enqueued)
+		return (<-j.result).unwrap(), waited
+	case <-queueTimeout:
+		log.Printf("request id=%s method=%s dropped after waiting %s for a worker", req.RequestID, req.Method, p.maxWait)
+		return &Response{RequestID: req.RequestID, Status: "ERROR", Error: "queue wait timeout", Code: ErrUnavailable}, time.Since(enqueued)
+	case <-ctx.Done():
+		log.Printf("request id=%s method=%s dropped: deadline passed while waiting for a worker", req.RequestID, req.Method)
+		return &Response{RequestID: req.RequestID, Status: "ERROR", Error: "deadline exceeded", Code: ErrDeadlineExceeded}, time.Since(enqueued)
+	}
+}
+
+// handlerPanic is a panic recovered on a handler goroutine, kept with its
+// stack so it can be re-raised on the connection goroutine
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// handlerResult is what a handler goroutine hands back: a response or a panic
+type handlerResult struct {
+	resp     *Response
+	panicked *handlerPanic
+}
+
+// callGuarded runs f, capturing a panic instead of letting it crash the
+// process from a goroutine nobody can recover
+func callGuarded(f func() *Response) (res handlerResult) {
+	defer func() {
+		if p := recover(); p != nil {
+			hp, ok := p.(*handlerPanic)
+			if !ok {
+				hp = &handlerPanic{value: p, stack: debug.Stack()}
+			}
+			res.panicked = hp
+		}
+	}()
+	return handlerResult{resp: f()}
+}
+
+// unwrap returns the response, re-raising a captured panic so handleConn
+// recovers it on the connection's goroutine
+func (r handlerResult) unwrap() *Response {
+	if r.panicked != nil {
+		panic(r.panicked)
+	}
+	return r.resp
+}
+
+// memCheckInterval is how often the memory watchdog samples allocations
+const memCheckInterval = 5 * time.Millisecond
+
+// runWithMemoryLimit runs processRequest while sampling the process-wide
+// allocation counter. If the bytes allocated since the request started exceed
+// limit, the request is answered with an error and the handler's context is
+// cancelled so it stops. This is deliberately coarse: concurrent requests
+// share the counter.
+func (s *Server) runWithMemoryLimit(ctx context.Context, req *Request, limit uint64) *Response {
+	if limit == 0 {
+		return s.processRequest(ctx, req)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start := allocatedBytes()
+	done := make(chan handlerResult, 1)
+	go func() { done <- callGuarded(func() *Response { return s.processRequest(ctx, req) }) }()
+
+	exceeded := func() *Response {
+		cancel()
+		log.Printf("request id=%s method=%s exceeded memory limit of %d bytes", req.RequestID, req.Method, limit)
+		return &Response{RequestID: req.RequestID, Status: "ERROR", Error: "memory limit exceeded", Code: ErrResourceLimit}
+	}
+
+	ticker := time.NewTicker(memCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case res := <-done:
+			if allocatedBytes()-start > limit {
+				return exceeded()
+			}
+			return res.unwrap()
+		case <-ticker.C:
+			if allocatedBytes()-start > limit {
+				return exceeded()
+			}
+		}
+	}
+}
+
+// allocatedBytes returns the cumulative bytes allocated on the heap
+func allocatedBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// callBudget is what a connection may still spend under -method-call-budget.
+// Each call costs its -method-cost weight, 1 unless set; a call that would
+// overspend is rejected without being charged. Calls on one connection are
+// served one at a time, so it needs no lock.
+type callBudget struct {
+	left  int
+	costs map[string]int
+}
+
+// newCallBudget returns a fresh budget for a connection, or nil when there is
+// no -method-call-budget
+func (s *Server) newCallBudget() *callBudget {
+	if s.cfg.MethodCallBudget <= 0 {
+		return nil
+	}
+	return &callBudget{left: s.cfg.MethodCallBudget, costs: s.methodCosts}
+}
+
+// spend charges one call to method, reporting false if the budget can't
+// cover it. A nil budget is unlimited.
+func (b *callBudget) spend(method string) bool {
+	if b == nil {
+		return true
+	}
+	cost, ok := b.costs[strings.ToLower(method)]
+	if !ok {
+		cost = 1
+	}
+	if cost > b.left {
+		return false
+	}
+	b.left -= cost
+	return true
+}
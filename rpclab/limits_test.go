@@ -0,0 +1,474 @@
+package rpclab
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimit(t *testing.T) {
+	s, err := NewServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.cfg.MaxRequestMemory = 8 << 20
+	// allocate mb megabytes, a chunk at a time so the watchdog sees it grow,
+	// and report on aborted if the context stops it first
+	aborted := make(chan bool, 1)
+	s.handlers["allocate"] = func(ctx context.Context, params map[string]interface{}) (interface{}, error) {
+		mb, err := asInt(params["mb"])
+		if err != nil {
+			return nil, err
+		}
+		var kept [][]byte
+		for i := int64(0); i < mb; i++ {
+			select {
+			case <-ctx.Done():
+				aborted <- true
+				return nil, ctx.Err()
+			case <-time.After(time.Millisecond):
+			}
+			kept = append(kept, make([]byte, 1<<20))
+		}
+		aborted <- false
+		return len(kept), nil
+	}
+	tests := []struct {
+		name    string
+		mb      int
+		code    string
+		aborted bool // the handler saw ctx.Done()
+	}{
+		{"within the limit", 1, "", false},
+		{"past the limit", 1000, ErrResourceLimit, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{RequestID: tt.name, Method: "allocate", Params: map[string]interface{}{"mb": tt.mb}}
+			resp := s.runWithMemoryLimit(context.Background(), req, s.cfg.MaxRequestMemory)
+			if resp.Code != tt.code {
+				t.Fatalf("code = %q (%s), want %q", resp.Code, resp.Error, tt.code)
+			}
+			if tt.code != "" && resp.Error != "memory limit exceeded" {
+				t.Errorf("error = %q, want memory limit exceeded", resp.Error)
+			}
+			select {
+			case got := <-aborted:
+				if got != tt.aborted {
+					t.Errorf("handler aborted = %t, want %t", got, tt.aborted)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler still running after its reply")
+			}
+		})
+	}
+}
+
+func TestRateLimitedWriter(t *testing.T) {
+	const rate = 20000 // bytes per second
+	tests := []struct {
+		size int
+		want time.Duration
+	}{
+		{2000, 100 * time.Millisecond},
+		{6000, 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.size), func(t *testing.T) {
+			var b bytes.Buffer
+			w := newRateLimitedWriter(&b, rate)
+			start := time.Now()
+			n, err := w.Write(make([]byte, tt.size))
+			took := time.Since(start)
+			if err != nil || n != tt.size || b.Len() != tt.size {
+				t.Fatalf("wrote %d (%d buffered), err %v; want %d", n, b.Len(), err, tt.size)
+			}
+			if took < tt.want*9/10 || took > tt.want+200*time.Millisecond {
+				t.Errorf("%d bytes took %s, want about %s", tt.size, took, tt.want)
+			}
+		})
+	}
+	var b bytes.Buffer
+	if w := newRateLimitedWriter(&b, 0); w != &b {
+		t.Error("rate 0 should leave the writer unthrottled")
+	}
+}
+
+func TestWriteRateSlowsResponses(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) { cfg.WriteRate = 5000 })
+	// a ~1.5KB response needs about 300ms at 5000 bytes per second
+	start := time.Now()
+	resp := call(t, addr, "reverse_string", map[string]interface{}{"s": strings.Repeat("ab", 750)})
+	if resp.Status != "OK" {
+		t.Fatalf("reverse_string: %+v", resp)
+	}
+	if took := time.Since(start); took < 250*time.Millisecond {
+		t.Errorf("response took %s, want at least 250ms at -write-rate 5000", took)
+	}
+}
+
+func TestSlowPoolLeavesFastMethods(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) {
+		cfg.SlowMethods = []string{"slow"}
+		cfg.SlowWorkers = 1
+	})
+	// one slow call holds the only slow worker and another queues behind it
+	slowDone := make(chan time.Duration, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+			defer c.Close()
+			start := time.Now()
+			c.Call("slow", map[string]interface{}{"sleep": 1})
+			slowDone <- time.Since(start)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, method := range []string{"ping", "add", "get_time"} {
+		start := time.Now()
+		resp := call(t, addr, method, map[string]interface{}{"a": 1, "b": 2})
+		if resp.Status != "OK" {
+			t.Errorf("%s: %+v", method, resp)
+		}
+		if took := time.Since(start); took > 300*time.Millisecond {
+			t.Errorf("%s took %s while the slow pool was busy", method, took)
+		}
+	}
+	// the pool really was saturated: the queued call waited for the first
+	first, second := <-slowDone, <-slowDone
+	if second < 1900*time.Millisecond {
+		t.Errorf("slow calls took %s and %s; the second should have queued", first, second)
+	}
+}
+
+func TestMaxAcceptRate(t *testing.T) {
+	const conns = 10
+	tests := []struct {
+		name     string
+		rate     float64
+		min, max time.Duration
+	}{
+		{"unthrottled", 0, 0, 300 * time.Millisecond},
+		// the first connection goes straight through, each later one waits 50ms
+		{"20 per second", 20, 400 * time.Millisecond, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, func(cfg *Config) { cfg.MaxAcceptRate = tt.rate })
+			start := time.Now()
+			errs := make(chan error, conns)
+			for i := 0; i < conns; i++ {
+				go func() {
+					c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+					defer c.Close()
+					_, err := c.Call("ping", nil)
+					errs <- err
+				}()
+			}
+			for i := 0; i < conns; i++ {
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+			}
+			if took := time.Since(start); took < tt.min || took > tt.max {
+				t.Errorf("%d connections served in %s, want %s to %s", conns, took, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestMaxQueueWait(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) {
+		cfg.SlowMethods = []string{"slow"}
+		cfg.SlowWorkers = 1
+		cfg.MaxQueueWait = 200 * time.Millisecond
+	})
+	// hold the only worker for a second
+	busy := make(chan error, 1)
+	go func() {
+		c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+		defer c.Close()
+		_, err := c.Call("slow", map[string]interface{}{"sleep": 1})
+		busy <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	resp := call(t, addr, "slow", map[string]interface{}{"sleep": 0})
+	took := time.Since(start)
+	if resp.Code != ErrUnavailable || resp.Error != "queue wait timeout" {
+		t.Fatalf("queued call = %+v, want a queue wait timeout", resp)
+	}
+	if took < 150*time.Millisecond || took > 800*time.Millisecond {
+		t.Errorf("dropped after %s, want about the 200ms -max-queue-wait", took)
+	}
+	// the call holding the worker is unaffected
+	if err := <-busy; err != nil {
+		t.Errorf("running call: %v", err)
+	}
+}
+
+func TestMethodCallBudget(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) {
+		cfg.MethodCallBudget = 5
+		cfg.MethodCosts = map[string]int{"slow": 2}
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	codec := &jsonCodec{in: newMessageReader(conn, 0, errRequestTooLarge), w: conn, enc: json.NewEncoder(conn)}
+	tests := []struct {
+		method string
+		code   string
+	}{
+		{"slow", ""},
+		{"slow", ""},
+		// 1 left: another slow call would overspend, and isn't charged
+		{"slow", ErrResourceLimit},
+		{"ping", ""},
+		{"ping", ErrResourceLimit},
+	}
+	for i, tt := range tests {
+		req := &Request{RequestID: fmt.Sprint(i), Method: tt.method, Params: map[string]interface{}{"sleep": 0}}
+		if err := codec.writeMessage(req); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := codec.readMessage()
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		var resp Response
+		if err := DecodeJSON(msg, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != tt.code {
+			t.Fatalf("call %d (%s): code = %q (%s), want %q", i, tt.method, resp.Code, resp.Error, tt.code)
+		}
+		if tt.code != "" && resp.Error != "connection budget exhausted" {
+			t.Errorf("call %d: error = %q, want connection budget exhausted", i, resp.Error)
+		}
+	}
+
+	// the budget is per connection
+	if resp := call(t, addr, "slow", map[string]interface{}{"sleep": 0}); resp.Status != "OK" {
+		t.Errorf("new connection: %s (%s), want OK", resp.Status, resp.Error)
+	}
+}
+
+func TestMethodCostValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		costs map[string]int
+	}{
+		{"unknown method", map[string]int{"nope": 1}},
+		{"negative cost", map[string]int{"slow": -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.MethodCallBudget = 10
+			cfg.MethodCosts = tt.costs
+			if _, err := NewServer(cfg); err == nil {
+				t.Error("NewServer accepted the costs")
+			}
+		})
+	}
+}
+
+func TestMaxActiveRequests(t *testing.T) {
+	s, addr := startServer(t, func(cfg *Config) { cfg.MaxActiveRequests = 2 })
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+			defer c.Close()
+			_, err := c.Call("slow", map[string]interface{}{"sleep": 1})
+			done <- err
+		}()
+	}
+	waitFor(t, func() bool { return len(s.activeSlots) == 2 })
+
+	tests := []struct {
+		method   string
+		params   map[string]interface{}
+		rejected bool
+	}{
+		// liveness probes bypass the cap
+		{"ping", nil, false},
+		{"add", map[string]interface{}{"a": 1, "b": 2}, true},
+		{"slow", map[string]interface{}{"sleep": 0}, true},
+	}
+	for _, tt := range tests {
+		resp := call(t, addr, tt.method, tt.params)
+		if !tt.rejected {
+			if resp.Status != "OK" {
+				t.Errorf("%s while saturated: %s (%s), want OK", tt.method, resp.Status, resp.Error)
+			}
+			continue
+		}
+		if resp.Code != ErrUnavailable || resp.Error != "server at capacity" {
+			t.Errorf("%s while saturated: %s %q (%s), want server at capacity", tt.method, resp.Status, resp.Error, resp.Code)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("saturating call: %v", err)
+		}
+	}
+	if resp := call(t, addr, "add", map[string]interface{}{"a": 1, "b": 2}); resp.Status != "OK" {
+		t.Errorf("after the slow calls: %s (%s), want OK", resp.Status, resp.Error)
+	}
+}
+
+func TestGzipRequests(t *testing.T) {
+	gzipped := func(s string) []byte {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write([]byte(s))
+		zw.Close()
+		return b.Bytes()
+	}
+	add := `{"request_id":"r1","method":"add","params":{"a":2,"b":3}}`
+	// a 1 MiB run of one letter compresses about a thousandfold
+	bomb := `{"request_id":"bomb","method":"echo","params":{"s":"` + strings.Repeat("a", 1<<20) + `"}}`
+	tests := []struct {
+		name     string
+		body     []byte
+		maxBytes int64
+		maxRatio int64
+		code     string
+		error    string
+	}{
+		{"plain", []byte(add), 64 << 10, 100, "", ""},
+		{"gzip", gzipped(add), 64 << 10, 100, "", ""},
+		{"past the size limit", gzipped(bomb), 64 << 10, 10000, ErrBadRequest, "decompressed request exceeds limits: more than 65536 bytes"},
+		{"past the ratio limit", gzipped(bomb), 8 << 20, 100, ErrBadRequest, "decompressed request exceeds limits: compression ratio above 100"},
+		{"bad gzip header", []byte{0x1f, 0x8b, 0, 0, 0}, 64 << 10, 100, ErrBadRequest, "invalid gzip stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, func(cfg *Config) {
+				cfg.MaxDecompressedBytes = tt.maxBytes
+				cfg.MaxCompressionRatio = tt.maxRatio
+			})
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write(tt.body); err != nil {
+				t.Fatal(err)
+			}
+			// the end of the gzip stream is the end of the connection's input
+			conn.(*net.TCPConn).CloseWrite()
+			msg, _, err := newMessageReader(conn, 0, errResponseTooLarge).next()
+			if err != nil {
+				t.Fatalf("no response: %v", err)
+			}
+			var resp Response
+			if err := DecodeJSON(msg, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code != tt.code {
+				t.Fatalf("code = %q (%s), want %q", resp.Code, resp.Error, tt.code)
+			}
+			if tt.code == "" && fmt.Sprint(resp.Result) != "5" {
+				t.Errorf("result = %v, want 5", resp.Result)
+			}
+			if tt.code != "" && resp.Error != tt.error {
+				t.Errorf("error = %q, want %q", resp.Error, tt.error)
+			}
+		})
+	}
+}
+
+// dialFrom connects to addr from the loopback address local, then sends a
+// ping and reports whether it was answered before the server hung up
+func dialFrom(t *testing.T, local, addr string) (net.Conn, bool) {
+	t.Helper()
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}, Timeout: 5 * time.Second}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	codec := &jsonCodec{in: newMessageReader(conn, 0, errResponseTooLarge), w: conn, enc: json.NewEncoder(conn)}
+	if err := codec.writeMessage(&Request{RequestID: "p", Method: "ping"}); err != nil {
+		return conn, false
+	}
+	_, err = codec.readMessage()
+	return conn, err == nil
+}
+
+func TestBanlist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "banlist")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# abusive clients\n127.0.0.2\n10.0.0.0/8\n")
+	s, addr := startServer(t, func(cfg *Config) { cfg.Banlist = path })
+
+	tests := []struct {
+		name      string
+		list      string // rewritten and reloaded first when set
+		reloadErr bool
+		local     string
+		served    bool
+	}{
+		{"allowed address", "", false, "127.0.0.1", true},
+		{"banned address", "", false, "127.0.0.2", false},
+		{"unbanned on reload", "10.0.0.0/8\n", false, "127.0.0.2", true},
+		{"banned range on reload", "127.0.0.0/8\n", false, "127.0.0.1", false},
+		// a broken file keeps the previous list
+		{"bad reload", "not an address\n", true, "127.0.0.3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.list != "" {
+				write(tt.list)
+				if err := s.bans.reload(); (err != nil) != tt.reloadErr {
+					t.Fatalf("reload: %v, want error %t", err, tt.reloadErr)
+				}
+			}
+			if _, served := dialFrom(t, tt.local, addr); served != tt.served {
+				t.Errorf("connection from %s served = %t, want %t", tt.local, served, tt.served)
+			}
+		})
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) { cfg.MaxConnsPerIP = 1 })
+	held, served := dialFrom(t, "127.0.0.1", addr)
+	if !served {
+		t.Fatal("first connection refused")
+	}
+	if _, served := dialFrom(t, "127.0.0.1", addr); served {
+		t.Error("second connection from the same address was served")
+	}
+	if _, served := dialFrom(t, "127.0.0.2", addr); !served {
+		t.Error("connection from another address was refused")
+	}
+	held.Close()
+	waitFor(t, func() bool {
+		conn, served := dialFrom(t, "127.0.0.1", addr)
+		conn.Close()
+		return served
+	})
+}
@@ -0,0 +1,795 @@
+package rpclab
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KnownMethod reports whether name (lowercased) is a method the server implements
+func KnownMethod(name string) bool {
+	_, ok := methodRegistry[name]
+	return ok
+}
+
+// configureMethods applies the -enable-methods and -disable-methods lists to
+// disabledMethods
+func (s *Server) configureMethods(enable, disable []string) error {
+	enabled := map[string]bool{}
+	for _, m := range enable {
+		if !KnownMethod(m) {
+			return fmt.Errorf("-enable-methods: unknown method %q", m)
+		}
+		enabled[m] = true
+		delete(s.disabledMethods, m)
+	}
+	for _, m := range disable {
+		if !KnownMethod(m) {
+			return fmt.Errorf("-disable-methods: unknown method %q", m)
+		}
+		if enabled[m] {
+			return fmt.Errorf("method %q is both enabled and disabled", m)
+		}
+		s.disabledMethods[m] = true
+	}
+	return nil
+}
+
+// methodTimeout returns the handler budget for method (0 = unlimited)
+func (s *Server) methodTimeout(method string) time.Duration {
+	if d, ok := s.methodTimeouts[method]; ok {
+		return d
+	}
+	return s.cfg.DefaultMethodTimeout
+}
+
+// ParamDescriptor describes one method parameter
+type ParamDescriptor struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+}
+
+// MethodDescriptor describes one callable method for the reflect method
+type MethodDescriptor struct {
+	Name       string            `json:"name"`
+	Desc       string            `json:"desc"`
+	Params     []ParamDescriptor `json:"params"`
+	Result     string            `json:"result"`
+	Deprecated bool              `json:"deprecated"`
+}
+
+// methodRegistry describes every method processRequest dispatches, keyed by
+// name; reflect and list_methods are both built from it, so keep it in sync
+// when adding a case there
+var methodRegistry = map[string]MethodDescriptor{
+	"add":              {Desc: "sum two integers", Params: []ParamDescriptor{{"a", "int", true}, {"b", "int", true}}, Result: "int"},
+	"subtract":         {Desc: "subtract b from a", Params: []ParamDescriptor{{"a", "int", true}, {"b", "int", true}}, Result: "int"},
+	"multiply":         {Desc: "multiply two integers", Params: []ParamDescriptor{{"a", "int", true}, {"b", "int", true}}, Result: "int"},
+	"divide":           {Desc: "divide a by b; float when inexact", Params: []ParamDescriptor{{"a", "int", true}, {"b", "int", true}}, Result: "int|float"},
+	"hash":             {Desc: "hex digest of s with md5, sha1 or sha256", Params: []ParamDescriptor{{"s", "string", true}, {"algo", "string", false}}, Result: "string"},
+	"ping":             {Desc: "liveness probe; answered even during -warmup", Params: []ParamDescriptor{}, Result: "string"},
+	"get_time":         {Desc: "server time in RFC 3339", Params: []ParamDescriptor{}, Result: "string"},
+	"reverse_string":   {Desc: "reverse a string", Params: []ParamDescriptor{{"s", "string", true}}, Result: "string"},
+	"transform":        {Desc: "apply op (upper, lower, title or reverse) to s", Params: []ParamDescriptor{{"s", "string", true}, {"op", "string", true}}, Result: "string"},
+	"slow":             {Desc: "sleep before answering, to exercise timeouts", Params: []ParamDescriptor{{"sleep", "int", false}, {"deadline_ms", "int", false}}, Result: "string"},
+	"crash":            {Desc: "exit the server process (needs -enable-methods=crash)", Params: []ParamDescriptor{}, Result: "string"},
+	"sleep_then_crash": {Desc: "sleep, answer, then exit (needs -enable-methods=sleep_then_crash or -enable-crash)", Params: []ParamDescriptor{{"sleep", "int", false}}, Result: "string"},
+	"sleep_random":     {Desc: "sleep a random min_ms..max_ms before answering (needs -enable-methods=sleep_random)", Params: []ParamDescriptor{{"min_ms", "int", true}, {"max_ms", "int", true}, {"deadline_ms", "int", false}}, Result: "int"},
+	"countdown":        {Desc: "stream from, from-1, ..., 1 as separate responses, then close the connection", Params: []ParamDescriptor{{"from", "int", true}, {"interval_ms", "int", false}}, Result: "stream of int"},
+	"echo":             {Desc: "return the params, plus server-side metadata with include_meta", Params: []ParamDescriptor{{"include_meta", "bool", false}}, Result: "object"},
+	"random":           {Desc: "uniform random integer in [min, max]", Params: []ParamDescriptor{{"min", "int", true}, {"max", "int", true}}, Result: "int"},
+	"ulid":             {Desc: "generate monotonic ULIDs", Params: []ParamDescriptor{{"count", "int", false}}, Result: "string|array"},
+	"slowest":          {Desc: "slowest recent requests", Params: []ParamDescriptor{}, Result: "array"},
+	"stats":            {Desc: "per-method request counts and uptime", Params: []ParamDescriptor{}, Result: "object"},
+	"quiesce":          {Desc: "stop accepting new work", Params: []ParamDescriptor{}, Result: "object"},
+	"unquiesce":        {Desc: "resume accepting work", Params: []ParamDescriptor{}, Result: "object"},
+	"reflect":          {Desc: "full service descriptor (needs -enable-methods=reflect or -enable-reflection)", Params: []ParamDescriptor{}, Result: "object"},
+	"list_methods":     {Desc: "names and descriptions of all methods", Params: []ParamDescriptor{}, Result: "array"},
+}
+
+// registeredMethods returns the registry sorted by name, with Name filled in
+func registeredMethods() []MethodDescriptor {
+	out := make([]MethodDescriptor, 0, len(methodRegistry))
+	for name, m := range methodRegistry {
+		m.Name = name
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// methodList is the list_methods result: one name/desc pair per method
+func methodList() []map[string]string {
+	methods := registeredMethods()
+	out := make([]map[string]string, len(methods))
+	for i, m := range methods {
+		out[i] = map[string]string{"name": m.Name, "desc": m.Desc}
+	}
+	return out
+}
+
+// serviceDescriptor assembles the reflect result from the method registry
+func serviceDescriptor() map[string]interface{} {
+	return map[string]interface{}{
+		"service": "rpc-go-lab",
+		"methods": registeredMethods(),
+	}
+}
+
+func (s *Server) processRequest(ctx context.Context, req *Request) *Response {
+	r := &Response{RequestID: req.RequestID}
+	start := time.Now()
+	defer func() { s.stats.record(req.Method, r, time.Since(start)) }()
+
+	if err := s.validateRequest(req); err != nil {
+		r.Status = "ERROR"
+		r.Error = err.Error()
+		r.Code = ErrBadRequest
+		return r
+	}
+
+	method := strings.ToLower(req.Method)
+	if s.disabledMethods[method] {
+		r.Status = "ERROR"
+		r.Error = fmt.Sprintf("method '%s' is disabled", req.Method)
+		r.Code = ErrMethodDisabled
+		return r
+	}
+	h, ok := s.handlers[method]
+	if !ok {
+		r.Status = "ERROR"
+		r.Error = fmt.Sprintf("unknown method '%s'", req.Method)
+		r.Code = ErrUnknownMethod
+		return r
+	}
+	result, err := s.callHandler(ctx, h, method, req.Params)
+	if err != nil {
+		r.Status = "ERROR"
+		r.Error = err.Error()
+		r.Code = ErrInternal
+		var me *methodError
+		if errors.As(err, &me) {
+			r.Code = me.code
+		}
+		switch r.Code {
+		case ErrDeadlineExceeded:
+			log.Printf("request id=%s abandoned %s: %v", req.RequestID, method, ctx.Err())
+		case ErrMethodTimeout:
+			log.Printf("request id=%s %s timed out after %v", req.RequestID, method, s.methodTimeout(method))
+		}
+		return r
+	}
+	r.Result = result
+	r.Status = "OK"
+	return r
+}
+
+// callHandler runs h in its own goroutine so a handler that hangs past its
+// method timeout can't hold the connection. On timeout the handler's
+// context is cancelled and it is left to finish in the background.
+func (s *Server) callHandler(ctx context.Context, h Handler, method string, params map[string]interface{}) (interface{}, error) {
+	budget := s.methodTimeout(method)
+	if budget <= 0 {
+		return h(ctx, params)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type outcome struct {
+		result   interface{}
+		err      error
+		panicked *handlerPanic
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		var o outcome
+		defer func() {
+			if p := recover(); p != nil {
+				o.panicked = &handlerPanic{value: p, stack: debug.Stack()}
+			}
+			done <- o
+		}()
+		o.result, o.err = h(ctx, params)
+	}()
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+	select {
+	case o := <-done:
+		if o.panicked != nil {
+			panic(o.panicked)
+		}
+		return o.result, o.err
+	case <-timer.C:
+		return nil, newMethodError(ErrMethodTimeout, fmt.Sprintf("method '%s' exceeded its %v timeout", method, budget))
+	}
+}
+
+// Handler implements one method. A returned *methodError sets the error
+// code sent to the client; any other error is reported as internal.
+type Handler func(ctx context.Context, params map[string]interface{}) (interface{}, error)
+
+// methodHandlers maps lowercased method names to their implementation
+func (s *Server) methodHandlers() map[string]Handler {
+	return map[string]Handler{
+		"add":              handleAdd,
+		"subtract":         handleSubtract,
+		"multiply":         handleMultiply,
+		"divide":           handleDivide,
+		"reverse_string":   handleReverseString,
+		"transform":        handleTransform,
+		"hash":             handleHash,
+		"ping":             handlePing,
+		"get_time":         s.handleGetTime,
+		"slow":             s.handleSlow,
+		"crash":            handleCrash,
+		"sleep_then_crash": s.handleSleepThenCrash,
+		"sleep_random":     s.handleSleepRandom,
+		"echo":             handleEcho,
+		"countdown":        handleCountdown,
+		"random":           handleRandom,
+		"ulid":             s.handleULID,
+		"slowest":          s.handleSlowest,
+		"stats":            s.handleStats,
+		"list_methods":     handleListMethods,
+		"quiesce":          s.quiesceHandler(true),
+		"unquiesce":        s.quiesceHandler(false),
+		"reflect":          handleReflect,
+	}
+}
+
+// methodError is a handler failure with the code reported to the client
+type methodError struct {
+	code string
+	msg  string
+}
+
+func (e *methodError) Error() string { return e.msg }
+
+func newMethodError(code, msg string) error {
+	return &methodError{code: code, msg: msg}
+}
+
+func badParams(msg string) error {
+	return newMethodError(ErrBadParams, msg)
+}
+
+// stringParam returns the required string param named key
+func stringParam(params map[string]interface{}, key string) (string, error) {
+	v, ok := params[key]
+	if !ok {
+		return "", badParams(fmt.Sprintf("missing param '%s'", key))
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", badParams(fmt.Sprintf("param '%s' must be string", key))
+	}
+	return s, nil
+}
+
+func handleAdd(_ context.Context, params map[string]interface{}) (interface{}, error) {
+	a, b, err := getTwoInts(params, "a", "b")
+	if err != nil {
+		return nil, badParams(err.Error())
+	}
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return nil, badParams("integer overflow")
+	}
+	return sum, nil
+}
+
+func handleSubtract(_ context.Context, params map[string]interface{}) (interface{}, error) {
+	a, b, err := getTwoInts(params, "a", "b")
+	if err != nil {
+		return nil, badParams(err.Error())
+	}
+	diff := a - b
+	if (b > 0 && diff > a) || (b < 0 && diff < a) {
+		return nil, badParams("integer overflow")
+	}
+	return diff, nil
+}
+
+func handleMultiply(_ context.Context, params map[string]interface{}) (interface{}, error) {
+	a, b, err := getTwoInts(params, "a", "b")
+	if err != nil {
+		return nil, badParams(err.Error())
+	}
+	product := a * b
+	if a != 0 && (product/a != b || (a == -1 && b == math.MinInt64)) {
+		return nil, badParams("integer overflow")
+	}
+	return product, nil
+}
+
+func handleDivide(_ context.Context, params map[string]interface{}) (interface{}, error) {
+	a, b, err := getTwoInts(params, "a", "b")
+	if err != nil {
+		return nil, badParams(err.Error())
+	}
+	if b == 0 {
+		return nil, badParams("division by zero")
+	}
+	// the one quotient that doesn't fit in an int64
+	if a == math.MinInt64 && b == -1 {
+		return nil, badParams("integer overflow")
+	}
+	// exact quotients stay integers; anything else is reported as a float
+	if a%b == 0 {
+		return a / b, nil
+	}
+	return float64(a) / float64(b), nil
+}
+
+func handleReverseString(_ context.Context, params map[string]interface{}) (interface{}, error) {
+	s, err := stringParam(params, "s")
+	if err != nil {
+		return nil, err
+	}
+	return reverseString(s), nil
+}
+
+// stringOps are the transform method's ops
+var stringOps = map[string]func(string) string{
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+	"title":   strings.Title,
+	"reverse": reverseString,
+}
+
+func handleTransform(_ context.Context, params map[string]interface{}) (interface{}, error) {
+	s, err := stringParam(params, "s")
+	if err != nil {
+		return nil, err
+	}
+	op, err := stringParam(params, "op")
+	if err != nil {
+		return nil, err
+	}
+	f, ok := stringOps[strings.ToLower(op)]
+	if !ok {
+		return nil, badParams(fmt.Sprintf("unsupported op '%s' (want upper, lower, title or reverse)", op))
+	}
+	return f(s), nil
+}
+
+func handleHash(_ context.Context, params map[string]interface{}) (interface{}, error) {
+	s, err := stringParam(params, "s")
+	if err != nil {
+		return nil, err
+	}
+	algo := "sha256"
+	if av, ok := params["algo"]; ok {
+		if algo, ok = av.(string); !ok {
+			return nil, badParams("param 'algo' must be string")
+		}
+	}
+	digest, err := hashHex(strings.ToLower(algo), s)
+	if err != nil {
+		return nil, badParams(err.Error())
+	}
+	return digest, nil
+}
+
+func handlePing(_ context.Context, _ map[string]interface{}) (interface{}, error) {
+	return "pong", nil
+}
+
+func (s *Server) handleGetTime(_ context.Context, _ map[string]interface{}) (interface{}, error) {
+	return s.clock.Now().Format(time.RFC3339), nil
+}
+
+func (s *Server) handleSlow(ctx context.Context, params map[string]interface{}) (interface{}, error) {
+	// optional 'sleep' param: seconds to sleep
+	secs, err := s.sleepParam(params, 5)
+	if err != nil {
+		return nil, badParams(err.Error())
+	}
+	log.Printf("Simulating slow processing: sleeping %d seconds", secs)
+	if err := sleepContext(ctx, time.Duration(secs)*time.Second); err != nil {
+		return nil, newMethodError(ErrDeadlineExceeded, "deadline exceeded")
+	}
+	return fmt.Sprintf("slept %d seconds", secs), nil
+}
+
+func handleCrash(_ context.Context, _ map[string]interface{}) (interface{}, error) {
+	// serveRequest sends this response and then exits the process
+	return "crashing", nil
+}
+
+func (s *Server) handleSleepThenCrash(ctx context.Context, params map[string]interface{}) (interface{}, error) {
+	// serveRequest sends this response and then exits the process
+	secs, err := s.sleepParam(params, 1)
+	if err != nil {
+		return nil, badParams(err.Error())
+	}
+	log.Printf("sleep_then_crash: sleeping %d seconds before crashing", secs)
+	if err := sleepContext(ctx, time.Duration(secs)*time.Second); err != nil {
+		// the crash only follows a successful response
+		return nil, newMethodError(ErrDeadlineExceeded, "deadline exceeded")
+	}
+	return fmt.Sprintf("slept %d seconds, crashing", secs), nil
+}
+
+func (s *Server) handleSleepRandom(ctx context.Context, params map[string]interface{}) (interface{}, error) {
+	lo, hi, err := getTwoInts(params, "min_ms", "max_ms")
+	if err != nil {
+		return nil, badParams(err.Error())
+	}
+	if lo < 0 || hi < lo {
+		return nil, badParams("params must satisfy 0 <= 'min_ms' <= 'max_ms'")
+	}
+	if s.cfg.MaxSleep > 0 && (hi > int64(math.MaxInt64/time.Millisecond) || time.Duration(hi)*time.Millisecond > s.cfg.MaxSleep) {
+		return nil, badParams(fmt.Sprintf("param 'max_ms' exceeds the server's -max-sleep of %v", s.cfg.MaxSleep))
+	}
+	ms, err := randInt(lo, hi)
+	if err != nil {
+		return nil, err
+	}
+	if err := sleepContext(ctx, time.Duration(ms)*time.Millisecond); err != nil {
+		return nil, newMethodError(ErrDeadlineExceeded, "deadline exceeded")
+	}
+	return ms, nil
+}
+
+func handleCountdown(_ context.Context, params map[string]interface{}) (interface{}, error) {
+	fv, ok := params["from"]
+	if !ok {
+		return nil, badParams("missing param 'from'")
+	}
+	from, err := asInt(fv)
+	if err != nil || from < 1 || from > maxCountdown {
+		return nil, badParams(fmt.Sprintf("param 'from' must be an integer between 1 and %d", maxCountdown))
+	}
+	// optional 'interval_ms' param: pause between frames
+	var interval int64
+	if iv, ok := params["interval_ms"]; ok {
+		if interval, err = asInt(iv); err != nil || interval < 0 || interval > maxCountdownInterval {
+			return nil, badParams(fmt.Sprintf("param 'interval_ms' must be an integer between 0 and %d", maxCountdownInterval))
+		}
+	}
+	return streamResult(func(ctx context.Context, emit func(interface{}) error) error {
+		for i := from; i >= 1; i-- {
+			if i < from && interval > 0 {
+				if err := sleepContext(ctx, time.Duration(interval)*time.Millisecond); err != nil {
+					return err
+				}
+			}
+			if err := emit(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}), nil
+}
+
+func handleEcho(ctx context.Context, params map[string]interface{}) (interface{}, error) {
+	// optional 'include_meta' param: wrap the params with what the server saw
+	if v, ok := params["include_meta"]; ok {
+		include, ok := v.(bool)
+		if !ok {
+			return nil, badParams("param 'include_meta' must be bool")
+		}
+		if include {
+			m := requestMetaFrom(ctx)
+			return map[string]interface{}{
+				"params":      params,
+				"remote":      m.remote,
+				"received_at": m.receivedAt.Format(time.RFC3339Nano),
+				"request_id":  m.requestID,
+				"conn_seq":    m.connSeq,
+			}, nil
+		}
+	}
+	return params, nil
+}
+
+func (s *Server) handleULID(_ context.Context, params map[string]interface{}) (interface{}, error) {
+	// optional 'count' param: return a list of ids instead of a single one
+	cv, ok := params["count"]
+	if !ok {
+		return newULID(s.clock.Now())
+	}
+	n, err := asInt(cv)
+	if err != nil || n < 1 || n > maxULIDCount {
+		return nil, badParams(fmt.Sprintf("param 'count' must be an integer between 1 and %d", maxULIDCount))
+	}
+	ids := make([]string, 0, n)
+	for i := int64(0); i < n; i++ {
+		id, err := newULID(s.clock.Now())
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func handleRandom(_ context.Context, params map[string]interface{}) (interface{}, error) {
+	lo, hi, err := getTwoInts(params, "min", "max")
+	if err != nil {
+		return nil, badParams(err.Error())
+	}
+	if hi < lo {
+		return nil, badParams("param 'max' must be >= 'min'")
+	}
+	return randInt(lo, hi)
+}
+
+func (s *Server) handleSlowest(_ context.Context, _ map[string]interface{}) (interface{}, error) {
+	if s.slowest.n <= 0 {
+		return nil, newMethodError(ErrMethodDisabled, "slowest request tracking disabled (-log-slowest-requests is 0)")
+	}
+	return s.slowest.snapshot(), nil
+}
+
+func (s *Server) handleStats(_ context.Context, _ map[string]interface{}) (interface{}, error) {
+	return s.stats.snapshot(), nil
+}
+
+func handleListMethods(_ context.Context, _ map[string]interface{}) (interface{}, error) {
+	return methodList(), nil
+}
+
+func (s *Server) quiesceHandler(on bool) Handler {
+	return func(_ context.Context, _ map[string]interface{}) (interface{}, error) {
+		s.SetQuiesced(on)
+		return map[string]interface{}{
+			"quiesced": s.quiesced.Load(),
+			// this admin request itself is counted
+			"in_flight": s.inFlight.Load() - 1,
+		}, nil
+	}
+}
+
+func handleReflect(_ context.Context, _ map[string]interface{}) (interface{}, error) {
+	return serviceDescriptor(), nil
+}
+
+// sleepContext sleeps for d unless ctx ends first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sleepParam reads the optional 'sleep' param (seconds) or returns def. It
+// fails for negative values and ones over -max-sleep.
+func (s *Server) sleepParam(params map[string]interface{}, def int) (int, error) {
+	secs := def
+	if sv, ok := params["sleep"]; ok {
+		switch t := sv.(type) {
+		case json.Number:
+			if f, err := t.Float64(); err == nil {
+				secs = int(math.Min(f, math.MaxInt32))
+			}
+		case float64:
+			secs = int(math.Min(t, math.MaxInt32))
+		case string:
+			if v, err := strconv.Atoi(t); err == nil {
+				secs = v
+			}
+		}
+	}
+	if secs < 0 {
+		return 0, fmt.Errorf("param 'sleep' must not be negative")
+	}
+	if s.cfg.MaxSleep > 0 && time.Duration(secs)*time.Second > s.cfg.MaxSleep {
+		return 0, fmt.Errorf("param 'sleep' exceeds the server's -max-sleep of %v", s.cfg.MaxSleep)
+	}
+	return secs, nil
+}
+
+func getTwoInts(params map[string]interface{}, ka, kb string) (int64, int64, error) {
+	av, ok := params[ka]
+	if !ok {
+		return 0, 0, fmt.Errorf("missing param '%s'", ka)
+	}
+	bv, ok := params[kb]
+	if !ok {
+		return 0, 0, fmt.Errorf("missing param '%s'", kb)
+	}
+	a, err := asInt(av)
+	if err != nil {
+		return 0, 0, fmt.Errorf("param '%s' error: %v", ka, err)
+	}
+	b, err := asInt(bv)
+	if err != nil {
+		return 0, 0, fmt.Errorf("param '%s' error: %v", kb, err)
+	}
+	return a, b, nil
+}
+
+var errIntRange = errors.New("integer out of range")
+
+// asInt converts a decoded param to an int64. Integers are exact; other
+// numbers truncate as float64 always did. Values outside the int64 range,
+// and non-finite floats, are errors rather than wrapping around.
+func asInt(v interface{}) (int64, error) {
+	switch t := v.(type) {
+	case json.Number:
+		iv, err := strconv.ParseInt(string(t), 10, 64)
+		if err == nil {
+			return iv, nil
+		}
+		if errors.Is(err, strconv.ErrRange) {
+			return 0, errIntRange
+		}
+		// a float too large to parse comes back as ±Inf, out of range below
+		if f, err := t.Float64(); err == nil || errors.Is(err, strconv.ErrRange) {
+			return floatToInt(f)
+		}
+	case float64:
+		return floatToInt(t)
+	case int:
+		return int64(t), nil
+	case int64:
+		return t, nil
+	case string:
+		iv, err := strconv.ParseInt(t, 10, 64)
+		if err == nil {
+			return iv, nil
+		}
+		if errors.Is(err, strconv.ErrRange) {
+			return 0, errIntRange
+		}
+	case bool:
+		// JSON true/false are never coerced to 1/0
+		return 0, errors.New("not an integer")
+	}
+	return 0, errors.New("not an integer")
+}
+
+// floatToInt truncates f, which must be finite and within the int64 range
+func floatToInt(f float64) (int64, error) {
+	if math.IsNaN(f) {
+		return 0, errors.New("not a finite number")
+	}
+	// -2^63 is exact as a float64 and math.MaxInt64 rounds up to 2^63, the
+	// first value past the range; ±Inf fall outside too
+	if f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, errIntRange
+	}
+	return int64(f), nil
+}
+
+// hashHex returns the hex digest of s using md5, sha1 or sha256
+func hashHex(algo, s string) (string, error) {
+	switch algo {
+	case "md5":
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:]), nil
+	case "sha1":
+		sum := sha1.Sum([]byte(s))
+		return hex.EncodeToString(sum[:]), nil
+	case "sha256":
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:]), nil
+	}
+	return "", fmt.Errorf("unsupported algo '%s' (want md5, sha1 or sha256)", algo)
+}
+
+func reverseString(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
+
+const maxULIDCount = 1000
+
+// bounds on countdown's 'from' and 'interval_ms' params
+const (
+	maxCountdown         = 1000
+	maxCountdownInterval = 10000
+)
+
+// crockford base32 alphabet used by ULIDs
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulid state: ids generated within the same millisecond increment the
+// random part so they still sort in generation order
+var (
+	ulidMu     sync.Mutex
+	ulidLastMs uint64
+	ulidLast   [10]byte
+)
+
+// newULID returns a 26 character ULID (48-bit ms timestamp + 80 bits of randomness)
+func newULID(now time.Time) (string, error) {
+	ulidMu.Lock()
+	defer ulidMu.Unlock()
+
+	ms := uint64(now.UnixMilli())
+	if ms <= ulidLastMs {
+		// same (or earlier) millisecond: bump the previous randomness by one
+		ms = ulidLastMs
+		i := len(ulidLast) - 1
+		for ; i >= 0; i-- {
+			ulidLast[i]++
+			if ulidLast[i] != 0 {
+				break
+			}
+		}
+		if i < 0 {
+			return "", errors.New("ulid randomness overflow")
+		}
+	} else {
+		if _, err := rand.Read(ulidLast[:]); err != nil {
+			return "", fmt.Errorf("ulid randomness: %v", err)
+		}
+		ulidLastMs = ms
+	}
+
+	var out [26]byte
+	ts := ms
+	for i := 9; i >= 0; i-- {
+		out[i] = ulidAlphabet[ts&31]
+		ts >>= 5
+	}
+	// encode the 80 random bits as two 40-bit halves of 8 chars each
+	for half := 0; half < 2; half++ {
+		var v uint64
+		for _, c := range ulidLast[half*5 : half*5+5] {
+			v = v<<8 | uint64(c)
+		}
+		for i := 7; i >= 0; i-- {
+			out[10+half*8+i] = ulidAlphabet[v&31]
+			v >>= 5
+		}
+	}
+	return string(out[:]), nil
+}
+
+// randInt returns a uniformly distributed integer in [lo, hi] from
+// crypto/rand, rejecting draws that would bias the modulo
+func randInt(lo, hi int64) (int64, error) {
+	span := uint64(hi-lo) + 1 // wraps to 0 when the range covers every int
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		v := binary.BigEndian.Uint64(b[:])
+		if span == 0 {
+			return int64(v), nil
+		}
+		if v < math.MaxUint64-math.MaxUint64%span {
+			return lo + int64(v%span), nil
+		}
+	}
+}
+
+// newShortID returns 16 random hex digits; it names server trace spans
+func newShortID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
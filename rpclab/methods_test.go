@@ -0,0 +1,756 @@
+package rpclab
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAsInt(t *testing.T) {
+	tests := []struct {
+		in   interface{}
+		want int64
+		err  bool
+	}{
+		{json.Number("42"), 42, false},
+		{json.Number("-9223372036854775808"), math.MinInt64, false},
+		{json.Number("9223372036854775807"), math.MaxInt64, false},
+		{json.Number("9223372036854775808"), 0, true},
+		{json.Number("-9223372036854775809"), 0, true},
+		{json.Number("2.9"), 2, false},
+		{json.Number("1e19"), 0, true},
+		{json.Number("1e400"), 0, true},
+		{float64(-3.5), -3, false},
+		{math.Inf(1), 0, true},
+		{math.NaN(), 0, true},
+		{float64(1 << 63), 0, true},
+		{"17", 17, false},
+		{"99999999999999999999", 0, true},
+		{true, 0, true},
+		{nil, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := asInt(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("asInt(%#v) = %d, %v; want %d, error %t", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestNegativeArithmetic(t *testing.T) {
+	tests := []struct {
+		method string
+		a, b   interface{}
+		result string
+		err    string
+	}{
+		{"subtract", json.Number("3"), json.Number("10"), "-7", ""},
+		{"subtract", json.Number("-3"), json.Number("-10"), "7", ""},
+		{"add", json.Number("-3"), json.Number("-10"), "-13", ""},
+		{"add", json.Number("-3"), json.Number("10"), "7", ""},
+		{"subtract", "-4", "6", "-10", ""},
+		{"add", true, json.Number("1"), "", "param 'a' error: not an integer"},
+		{"subtract", json.Number("1"), false, "", "param 'b' error: not an integer"},
+	}
+	handlers := map[string]Handler{"add": handleAdd, "subtract": handleSubtract}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s(%v,%v)", tt.method, tt.a, tt.b), func(t *testing.T) {
+			got, err := handlers[tt.method](context.Background(), map[string]interface{}{"a": tt.a, "b": tt.b})
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || fmt.Sprint(got) != tt.result {
+				t.Errorf("got %v, %v; want %s", got, err, tt.result)
+			}
+		})
+	}
+}
+
+func TestArithmeticBeyondFloatPrecision(t *testing.T) {
+	_, addr := startServer(t, nil)
+	tests := []struct {
+		method string
+		a, b   interface{}
+		result string
+		code   string
+	}{
+		// both operands and the sum are past 2^53, where float64 loses integers
+		{"add", int64(1<<53 + 1), int64(1<<53 + 3), "18014398509481988", ""},
+		{"subtract", int64(1<<62 + 1), int64(1), "4611686018427387904", ""},
+		{"multiply", int64(1<<31 + 1), int64(1<<31 + 1), "4611686022722355201", ""},
+		{"add", int64(math.MaxInt64), int64(1), "", ErrBadParams},
+		{"subtract", int64(math.MinInt64), int64(1), "", ErrBadParams},
+		{"multiply", int64(1 << 32), int64(1 << 32), "", ErrBadParams},
+		{"add", json.Number("9223372036854775808"), int64(0), "", ErrBadParams},
+		{"add", json.Number("1e300"), int64(0), "", ErrBadParams},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("%s(%v,%v)", tt.method, tt.a, tt.b)
+		t.Run(name, func(t *testing.T) {
+			resp := call(t, addr, tt.method, map[string]interface{}{"a": tt.a, "b": tt.b})
+			if resp.Code != tt.code {
+				t.Fatalf("code = %q (%s), want %q", resp.Code, resp.Error, tt.code)
+			}
+			if got := fmt.Sprint(resp.Result); tt.code == "" && got != tt.result {
+				t.Errorf("result = %s, want %s", got, tt.result)
+			}
+		})
+	}
+}
+
+func TestDivide(t *testing.T) {
+	_, addr := startServer(t, nil)
+	tests := []struct {
+		name   string
+		params map[string]interface{}
+		result string
+		code   string
+		err    string
+	}{
+		{"exact", map[string]interface{}{"a": 12, "b": 4}, "3", "", ""},
+		{"negative", map[string]interface{}{"a": -12, "b": 4}, "-3", "", ""},
+		{"inexact", map[string]interface{}{"a": 7, "b": 2}, "3.5", "", ""},
+		{"large exact", map[string]interface{}{"a": int64(1<<62 + 2), "b": 2}, "2305843009213693953", "", ""},
+		{"min int64 by -1", map[string]interface{}{"a": int64(math.MinInt64), "b": -1}, "", ErrBadParams, "integer overflow"},
+		{"zero divisor", map[string]interface{}{"a": 1, "b": 0}, "", ErrBadParams, "division by zero"},
+		{"missing a", map[string]interface{}{"b": 2}, "", ErrBadParams, "missing param 'a'"},
+		{"missing b", map[string]interface{}{"a": 2}, "", ErrBadParams, "missing param 'b'"},
+		{"not a number", map[string]interface{}{"a": "x", "b": 2}, "", ErrBadParams, "param 'a' error: not an integer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := call(t, addr, "divide", tt.params)
+			if resp.Code != tt.code || resp.Error != tt.err {
+				t.Fatalf("got code %q error %q, want %q %q", resp.Code, resp.Error, tt.code, tt.err)
+			}
+			if got := fmt.Sprint(resp.Result); tt.code == "" && got != tt.result {
+				t.Errorf("result = %s, want %s", got, tt.result)
+			}
+		})
+	}
+}
+
+func TestTransform(t *testing.T) {
+	_, addr := startServer(t, nil)
+	tests := []struct {
+		name   string
+		params map[string]interface{}
+		result string
+		err    string
+	}{
+		{"upper", map[string]interface{}{"s": "héllo world", "op": "upper"}, "HÉLLO WORLD", ""},
+		{"lower", map[string]interface{}{"s": "HÉLLO World", "op": "lower"}, "héllo world", ""},
+		{"title", map[string]interface{}{"s": "hello big world", "op": "title"}, "Hello Big World", ""},
+		{"reverse", map[string]interface{}{"s": "héllo", "op": "reverse"}, "olléh", ""},
+		{"op case ignored", map[string]interface{}{"s": "abc", "op": "UPPER"}, "ABC", ""},
+		{"empty string", map[string]interface{}{"s": "", "op": "upper"}, "", ""},
+		{"unknown op", map[string]interface{}{"s": "abc", "op": "rot13"}, "", "unsupported op 'rot13' (want upper, lower, title or reverse)"},
+		{"missing s", map[string]interface{}{"op": "upper"}, "", "missing param 's'"},
+		{"missing op", map[string]interface{}{"s": "abc"}, "", "missing param 'op'"},
+		{"s not a string", map[string]interface{}{"s": 5, "op": "upper"}, "", "param 's' must be string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := call(t, addr, "transform", tt.params)
+			if tt.err != "" {
+				if resp.Code != ErrBadParams || resp.Error != tt.err {
+					t.Fatalf("got code %q error %q, want bad_params %q", resp.Code, resp.Error, tt.err)
+				}
+				return
+			}
+			if resp.Status != "OK" || resp.Result != tt.result {
+				t.Errorf("got %v (%s), want %q", resp.Result, resp.Error, tt.result)
+			}
+		})
+	}
+}
+
+func TestRandInt(t *testing.T) {
+	tests := []struct {
+		lo, hi int64
+		iters  int
+	}{
+		{1, 6, 2000},
+		{5, 5, 50},
+		{-3, 3, 2000},
+		{math.MaxInt64 - 1, math.MaxInt64, 200},
+		{math.MinInt64, math.MaxInt64, 200},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("[%d,%d]", tt.lo, tt.hi), func(t *testing.T) {
+			seen := map[int64]bool{}
+			for i := 0; i < tt.iters; i++ {
+				v, err := randInt(tt.lo, tt.hi)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v < tt.lo || v > tt.hi {
+					t.Fatalf("randInt(%d, %d) = %d, out of range", tt.lo, tt.hi, v)
+				}
+				seen[v] = true
+			}
+			// small ranges should have every value turn up
+			if span := tt.hi - tt.lo + 1; span > 0 && span <= 7 && int64(len(seen)) != span {
+				t.Errorf("saw %d of %d values in %d draws", len(seen), span, tt.iters)
+			}
+		})
+	}
+}
+
+func TestRandomMethod(t *testing.T) {
+	_, addr := startServer(t, nil)
+	tests := []struct {
+		name   string
+		params map[string]interface{}
+		err    string
+	}{
+		{"die", map[string]interface{}{"min": 1, "max": 6}, ""},
+		{"single value", map[string]interface{}{"min": 7, "max": 7}, ""},
+		{"inverted range", map[string]interface{}{"min": 6, "max": 1}, "param 'max' must be >= 'min'"},
+		{"missing max", map[string]interface{}{"min": 1}, "missing param 'max'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := call(t, addr, "random", tt.params)
+			if tt.err != "" {
+				if resp.Code != ErrBadParams || resp.Error != tt.err {
+					t.Fatalf("got code %q error %q, want bad_params %q", resp.Code, resp.Error, tt.err)
+				}
+				return
+			}
+			v, err := asInt(resp.Result)
+			lo, _ := asInt(tt.params["min"])
+			hi, _ := asInt(tt.params["max"])
+			if err != nil || v < lo || v > hi {
+				t.Errorf("result = %v, want an integer in [%d, %d]", resp.Result, lo, hi)
+			}
+		})
+	}
+}
+
+func TestHandlerRegistry(t *testing.T) {
+	s, err := NewServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every described method has a handler and every handler is described
+	for name := range methodRegistry {
+		if s.handlers[name] == nil {
+			t.Errorf("%s is described but has no handler", name)
+		}
+	}
+	for name := range s.handlers {
+		if !KnownMethod(name) {
+			t.Errorf("handler %s is missing from methodRegistry", name)
+		}
+	}
+
+	tests := []struct {
+		method string
+		params map[string]interface{}
+		want   string
+		code   string
+		errMsg string
+	}{
+		{"add", map[string]interface{}{"a": 2, "b": 3}, "5", "", ""},
+		{"ADD", map[string]interface{}{"a": 2, "b": 3}, "5", "", ""},
+		{"ping", nil, "pong", "", ""},
+		{"add", map[string]interface{}{"a": 2}, "<nil>", ErrBadParams, "missing param 'b'"},
+		{"no_such_method", nil, "<nil>", ErrUnknownMethod, "unknown method 'no_such_method'"},
+		{"", nil, "<nil>", ErrUnknownMethod, "unknown method ''"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			resp := s.processRequest(context.Background(), &Request{RequestID: "1", Method: tt.method, Params: tt.params})
+			if resp.Code != tt.code || fmt.Sprint(resp.Result) != tt.want {
+				t.Fatalf("got %v, code %q (%s); want %s, code %q", resp.Result, resp.Code, resp.Error, tt.want, tt.code)
+			}
+			if tt.code != "" && !strings.Contains(resp.Error, tt.errMsg) {
+				t.Errorf("error = %q, want %q", resp.Error, tt.errMsg)
+			}
+		})
+	}
+
+	t.Run("handler in isolation", func(t *testing.T) {
+		got, err := handleMultiply(context.Background(), map[string]interface{}{"a": 6, "b": 7})
+		if err != nil || fmt.Sprint(got) != "42" {
+			t.Errorf("handleMultiply = %v, %v; want 42", got, err)
+		}
+	})
+}
+
+func TestMethodAllowlist(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		method    string
+		params    map[string]interface{}
+		code      string
+		exits     bool
+	}{
+		{"crash off by default", nil, "crash", nil, ErrMethodDisabled, false},
+		{"sleep_then_crash off by default", nil, "sleep_then_crash", map[string]interface{}{"sleep": 0}, ErrMethodDisabled, false},
+		{"sleep_random off by default", nil, "sleep_random", map[string]interface{}{"min_ms": 0, "max_ms": 1}, ErrMethodDisabled, false},
+		{"reflect off by default", nil, "reflect", nil, ErrMethodDisabled, false},
+		{"enable crash", func(c *Config) { c.EnableMethods = []string{"crash"} }, "crash", nil, "", true},
+		{"enable sleep_then_crash", func(c *Config) { c.EnableMethods = []string{"sleep_then_crash"} }, "sleep_then_crash", map[string]interface{}{"sleep": 0}, "", true},
+		{"-enable-crash alias", func(c *Config) { c.EnableCrash = true }, "sleep_then_crash", map[string]interface{}{"sleep": 0}, "", true},
+		{"-enable-crash leaves crash off", func(c *Config) { c.EnableCrash = true }, "crash", nil, ErrMethodDisabled, false},
+		{"enable reflect", func(c *Config) { c.EnableMethods = []string{"reflect"} }, "reflect", nil, "", false},
+		{"-enable-reflection alias", func(c *Config) { c.EnableReflection = true }, "reflect", nil, "", false},
+		{"disable slow", func(c *Config) { c.DisableMethods = []string{"slow"} }, "slow", map[string]interface{}{"sleep": 5}, ErrMethodDisabled, false},
+		{"slowest with tracking off", func(c *Config) { c.LogSlowestRequests = 0 }, "slowest", nil, ErrMethodDisabled, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			if tt.configure != nil {
+				tt.configure(&cfg)
+			}
+			s, err := NewServer(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exited := make(chan int, 1)
+			s.exit = func(code int) { exited <- code }
+			addr := serve(t, s)
+
+			start := time.Now()
+			resp := call(t, addr, tt.method, tt.params)
+			if resp.Code != tt.code {
+				t.Fatalf("code = %q (%s), want %q", resp.Code, resp.Error, tt.code)
+			}
+			if tt.code == ErrMethodDisabled && time.Since(start) > time.Second {
+				t.Errorf("disabled method ran for %v", time.Since(start))
+			}
+			select {
+			case <-exited:
+				if !tt.exits {
+					t.Error("server exited")
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.exits {
+					t.Error("server did not exit")
+				}
+			}
+		})
+	}
+}
+
+func TestMethodAllowlistConflicts(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+	}{
+		{"unknown enable", func(c *Config) { c.EnableMethods = []string{"nope"} }},
+		{"unknown disable", func(c *Config) { c.DisableMethods = []string{"nope"} }},
+		{"both", func(c *Config) { c.EnableMethods, c.DisableMethods = []string{"crash"}, []string{"crash"} }},
+		{"alias and disable", func(c *Config) { c.EnableCrash, c.DisableMethods = true, []string{"sleep_then_crash"} }},
+	}
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		tt.configure(&cfg)
+		if _, err := NewServer(cfg); err == nil {
+			t.Errorf("%s: NewServer succeeded", tt.name)
+		}
+	}
+}
+
+func TestMethodTimeouts(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		method    string
+		params    map[string]interface{}
+		code      string
+	}{
+		// the default budget is longer than -max-sleep, so a slow method finishes
+		{"finite default", nil, "slow", map[string]interface{}{"sleep": 1}, ""},
+		{"default of 0 is unlimited", func(c *Config) { c.DefaultMethodTimeout = 0 }, "slow", map[string]interface{}{"sleep": 1}, ""},
+		{"unlisted method gets the default", func(c *Config) {
+			c.DefaultMethodTimeout = 100 * time.Millisecond
+			c.MethodTimeouts = map[string]time.Duration{"add": time.Second}
+		}, "slow", map[string]interface{}{"sleep": 1}, ErrMethodTimeout},
+		{"per-method budget", func(c *Config) { c.MethodTimeouts = map[string]time.Duration{"slow": 100 * time.Millisecond} }, "slow", map[string]interface{}{"sleep": 1}, ErrMethodTimeout},
+		{"other methods unaffected", func(c *Config) { c.MethodTimeouts = map[string]time.Duration{"slow": 100 * time.Millisecond} }, "add", map[string]interface{}{"a": 1, "b": 2}, ""},
+		{"default budget", func(c *Config) { c.DefaultMethodTimeout = 100 * time.Millisecond }, "slow", map[string]interface{}{"sleep": 1}, ErrMethodTimeout},
+		{"listed method overrides default", func(c *Config) {
+			c.DefaultMethodTimeout = 100 * time.Millisecond
+			c.MethodTimeouts = map[string]time.Duration{"slow": 0}
+		}, "slow", map[string]interface{}{"sleep": 1}, ""},
+	}
+	if cfg := DefaultConfig(); cfg.DefaultMethodTimeout <= cfg.MaxSleep {
+		t.Errorf("default method timeout %v doesn't outlast -max-sleep %v", cfg.DefaultMethodTimeout, cfg.MaxSleep)
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			_, addr := startServer(t, tt.configure)
+			resp := call(t, addr, tt.method, tt.params)
+			if resp.Code != tt.code {
+				t.Errorf("code = %q (%s), want %q", resp.Code, resp.Error, tt.code)
+			}
+		})
+	}
+}
+
+func TestDefaultParams(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) {
+		cfg.DefaultParams = map[string]map[string]interface{}{
+			"slow": {"sleep": json.Number("1")},
+			"echo": {"tag": "default", "level": json.Number("2")},
+		}
+	})
+	tests := []struct {
+		name    string
+		method  string
+		params  map[string]interface{}
+		want    string        // the echoed params, when set
+		minTook time.Duration // how long a slow call must take
+		maxTook time.Duration
+	}{
+		{"default fills in", "echo", nil, "map[level:2 tag:default]", 0, 0},
+		{"client value wins", "echo", map[string]interface{}{"tag": "mine"}, "map[level:2 tag:mine]", 0, 0},
+		{"merged with client keys", "echo", map[string]interface{}{"extra": true}, "map[extra:true level:2 tag:default]", 0, 0},
+		{"slow uses the default sleep", "slow", nil, "", time.Second, 0},
+		{"method name case ignored", "SLOW", nil, "", time.Second, 0},
+		{"slow with its own sleep", "slow", map[string]interface{}{"sleep": 0}, "", 0, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			resp := call(t, addr, tt.method, tt.params)
+			took := time.Since(start)
+			if resp.Status != "OK" {
+				t.Fatalf("%s: %s (%s)", tt.method, resp.Status, resp.Error)
+			}
+			if tt.want != "" && fmt.Sprint(resp.Result) != tt.want {
+				t.Errorf("echoed %v, want %s", resp.Result, tt.want)
+			}
+			if took < tt.minTook || tt.maxTook > 0 && took > tt.maxTook {
+				t.Errorf("took %s, want between %s and %s", took, tt.minTook, tt.maxTook)
+			}
+		})
+	}
+}
+
+func TestMaxSleep(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxSleep time.Duration
+		sleep    interface{}
+		want     int
+		err      string
+	}{
+		{"default", time.Minute, nil, 5, ""},
+		{"at the bound", time.Minute, json.Number("60"), 60, ""},
+		{"over the bound", time.Minute, json.Number("61"), 0, "param 'sleep' exceeds the server's -max-sleep of 1m0s"},
+		{"a day", time.Minute, json.Number("100000"), 0, "param 'sleep' exceeds the server's -max-sleep of 1m0s"},
+		{"unlimited", 0, json.Number("100000"), 100000, ""},
+		{"negative", time.Minute, json.Number("-1"), 0, "param 'sleep' must not be negative"},
+		{"negative string", 0, "-3", 0, "param 'sleep' must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{cfg: Config{MaxSleep: tt.maxSleep}}
+			params := map[string]interface{}{}
+			if tt.sleep != nil {
+				params["sleep"] = tt.sleep
+			}
+			got, err := s.sleepParam(params, 5)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("sleepParam = %d, %v; want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxSleepMethods(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) {
+		cfg.MaxSleep = time.Second
+		cfg.EnableMethods = []string{"sleep_random"}
+	})
+	tests := []struct {
+		method string
+		params map[string]interface{}
+		err    string
+	}{
+		{"slow", map[string]interface{}{"sleep": 2}, "param 'sleep' exceeds the server's -max-sleep of 1s"},
+		{"slow", map[string]interface{}{"sleep": -1}, "param 'sleep' must not be negative"},
+		{"sleep_random", map[string]interface{}{"min_ms": 0, "max_ms": 1001}, "param 'max_ms' exceeds the server's -max-sleep of 1s"},
+		{"sleep_random", map[string]interface{}{"min_ms": 0, "max_ms": 5}, ""},
+		// too many milliseconds to fit a Duration
+		{"sleep_random", map[string]interface{}{"min_ms": 0, "max_ms": int64(math.MaxInt64 / 1000)}, "param 'max_ms' exceeds the server's -max-sleep of 1s"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.method, tt.params), func(t *testing.T) {
+			resp := call(t, addr, tt.method, tt.params)
+			if tt.err == "" {
+				if resp.Status != "OK" {
+					t.Fatalf("got %+v, want OK", resp)
+				}
+				return
+			}
+			if resp.Code != ErrBadParams || resp.Error != tt.err {
+				t.Errorf("got code %q error %q, want bad_params %q", resp.Code, resp.Error, tt.err)
+			}
+		})
+	}
+}
+
+func TestSleepThenCrash(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]interface{}
+		timeout time.Duration // -default-method-timeout
+		code    string
+		exits   bool
+	}{
+		{"responds then exits", map[string]interface{}{"sleep": 0}, 0, "", true},
+		{"deadline_ms cuts the sleep short", map[string]interface{}{"sleep": 5, "deadline_ms": 100}, 0, ErrDeadlineExceeded, false},
+		{"method timeout cuts the sleep short", map[string]interface{}{"sleep": 5}, 100 * time.Millisecond, ErrMethodTimeout, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.EnableCrash = true
+			cfg.DefaultMethodTimeout = tt.timeout
+			s, err := NewServer(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the injected exit holds the "crash" until the test has read the
+			// response, so a response written after exit would never arrive
+			received := make(chan struct{})
+			exited := make(chan int, 1)
+			s.exit = func(code int) {
+				select {
+				case <-received:
+				case <-time.After(2 * time.Second):
+				}
+				exited <- code
+			}
+			addr := serve(t, s)
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			codec := &jsonCodec{in: newMessageReader(conn, 0, errRequestTooLarge), w: conn, enc: json.NewEncoder(conn)}
+			if err := codec.writeMessage(&Request{RequestID: "stc", Method: "sleep_then_crash", Params: tt.params}); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := codec.readMessage()
+			if err != nil {
+				t.Fatalf("no response before the crash: %v", err)
+			}
+			close(received)
+			var resp Response
+			if err := DecodeJSON(msg, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code != tt.code {
+				t.Fatalf("code = %q (%s), want %q", resp.Code, resp.Error, tt.code)
+			}
+			wait := 200 * time.Millisecond
+			if tt.exits {
+				wait = 3 * time.Second
+			}
+			select {
+			case code := <-exited:
+				if !tt.exits {
+					t.Errorf("server exited with %d", code)
+				} else if code != 1 {
+					t.Errorf("exit code = %d, want 1", code)
+				}
+			case <-time.After(wait):
+				if tt.exits {
+					t.Error("server did not exit")
+				}
+			}
+		})
+	}
+}
+
+// decodeULIDTime returns the millisecond timestamp in a ULID's first 10 chars
+func decodeULIDTime(id string) int64 {
+	var ms int64
+	for _, c := range id[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(ulidAlphabet, c))
+	}
+	return ms
+}
+
+func TestNewULID(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		times []time.Time
+		// the ids carry their own time rather than a later one
+		ownTime bool
+	}{
+		{"same millisecond", []time.Time{base, base, base, base}, true},
+		{"advancing clock", []time.Time{base, base.Add(time.Millisecond), base.Add(time.Second), base.Add(time.Hour)}, true},
+		// a clock stepping backwards still yields increasing ids
+		{"clock going back", []time.Time{base.Add(3 * time.Hour), base.Add(2 * time.Hour), base}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// forget ids made by other tests with the real clock
+			ulidMu.Lock()
+			ulidLastMs = 0
+			ulidMu.Unlock()
+			prev := ""
+			for _, now := range tt.times {
+				id, err := newULID(now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(id) != 26 || strings.Trim(id, ulidAlphabet) != "" {
+					t.Fatalf("%q is not 26 Crockford base32 chars", id)
+				}
+				if ms := decodeULIDTime(id); tt.ownTime && ms != now.UnixMilli() {
+					t.Errorf("%s encodes %d, want %d", id, ms, now.UnixMilli())
+				}
+				if id <= prev {
+					t.Errorf("%s does not sort after %s", id, prev)
+				}
+				prev = id
+			}
+		})
+	}
+}
+
+func TestULIDMethod(t *testing.T) {
+	_, addr := startServer(t, nil)
+	tests := []struct {
+		name   string
+		params map[string]interface{}
+		n      int
+		code   string
+	}{
+		{"single", nil, 1, ""},
+		{"list", map[string]interface{}{"count": 50}, 50, ""},
+		{"zero", map[string]interface{}{"count": 0}, 0, ErrBadParams},
+		{"too many", map[string]interface{}{"count": maxULIDCount + 1}, 0, ErrBadParams},
+		{"not a number", map[string]interface{}{"count": "many"}, 0, ErrBadParams},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := call(t, addr, "ulid", tt.params)
+			if resp.Code != tt.code {
+				t.Fatalf("code = %q (%s), want %q", resp.Code, resp.Error, tt.code)
+			}
+			if tt.code != "" {
+				return
+			}
+			var ids []string
+			switch r := resp.Result.(type) {
+			case string:
+				ids = []string{r}
+			case []interface{}:
+				for _, v := range r {
+					ids = append(ids, v.(string))
+				}
+			}
+			if len(ids) != tt.n {
+				t.Fatalf("got %d ids, want %d", len(ids), tt.n)
+			}
+			if !sort.StringsAreSorted(ids) {
+				t.Errorf("ids not in order: %v", ids)
+			}
+		})
+	}
+}
+
+func TestConnSeq(t *testing.T) {
+	_, addr := startServer(t, nil)
+	// connSeq echoes the request's position on the client's pooled connection
+	connSeq := func(c *Client) string {
+		t.Helper()
+		resp, err := c.Call("echo", map[string]interface{}{"include_meta": true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, ok := resp.Result.(map[string]interface{})
+		if !ok {
+			t.Fatalf("result = %v, want an object", resp.Result)
+		}
+		return fmt.Sprint(m["conn_seq"])
+	}
+	first := NewClient(addr, ClientConfig{Timeout: 5 * time.Second, PoolSize: 1})
+	defer first.Close()
+	second := NewClient(addr, ClientConfig{Timeout: 5 * time.Second, PoolSize: 1})
+	defer second.Close()
+	steps := []struct {
+		c    *Client
+		want string
+	}{
+		{first, "1"},
+		{first, "2"},
+		{second, "1"}, // each connection counts on its own
+		{first, "3"},
+		{second, "2"},
+	}
+	for i, st := range steps {
+		if got := connSeq(st.c); got != st.want {
+			t.Errorf("step %d: conn_seq = %s, want %s", i, got, st.want)
+		}
+	}
+}
+
+func TestReflectDescriptor(t *testing.T) {
+	s, addr := startServer(t, func(cfg *Config) { cfg.EnableReflection = true })
+	resp := call(t, addr, "reflect", nil)
+	if resp.Status != "OK" {
+		t.Fatalf("reflect: %+v", resp)
+	}
+	raw, _ := json.Marshal(resp.Result)
+	var desc struct {
+		Service string             `json:"service"`
+		Methods []MethodDescriptor `json:"methods"`
+	}
+	if err := json.Unmarshal(raw, &desc); err != nil {
+		t.Fatalf("decode %s: %v", raw, err)
+	}
+	if desc.Service != "rpc-go-lab" {
+		t.Errorf("service = %q", desc.Service)
+	}
+	byName := map[string]MethodDescriptor{}
+	for _, m := range desc.Methods {
+		byName[m.Name] = m
+	}
+
+	add, ok := byName["add"]
+	if !ok {
+		t.Fatal("descriptor has no add method")
+	}
+	want := []ParamDescriptor{{"a", "int", true}, {"b", "int", true}}
+	if fmt.Sprint(add.Params) != fmt.Sprint(want) || add.Result != "int" || add.Deprecated {
+		t.Errorf("add = %+v, want params %v and an int result", add, want)
+	}
+	// every method the server dispatches is described
+	for name := range s.handlers {
+		if _, ok := byName[name]; !ok && name != jsonrpcInvalid {
+			t.Errorf("method %s missing from the descriptor", name)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package rpclab
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// resultChecksum returns "<algo>:<hex digest>" of the serialized result bytes
+func resultChecksum(algo string, b []byte) string {
+	if algo == "sha256" {
+		sum := sha256.Sum256(b)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	return fmt.Sprintf("crc32:%08x", crc32.ChecksumIEEE(b))
+}
+
+// Page is an array result sliced by the limit/offset params
+type Page struct {
+	Items      interface{} `json:"items"`
+	Total      int         `json:"total"`
+	Offset     int         `json:"offset"`
+	NextOffset *int        `json:"next_offset"` // null on the last page
+}
+
+// pageResult replaces an array result with one page of it when the request
+// asked for paging via 'limit' and/or 'offset'
+func pageResult(resp *Response, params map[string]interface{}) error {
+	lv, hasLimit := params["limit"]
+	ov, hasOffset := params["offset"]
+	if !hasLimit && !hasOffset {
+		return nil
+	}
+	rv := reflect.ValueOf(resp.Result)
+	if rv.Kind() != reflect.Slice {
+		return nil
+	}
+	total := rv.Len()
+	offset, limit := 0, total
+	if hasOffset {
+		n, err := asInt(ov)
+		if err != nil || n < 0 {
+			return errors.New("param 'offset' must be a non-negative integer")
+		}
+		offset = int(n)
+	}
+	if hasLimit {
+		n, err := asInt(lv)
+		if err != nil || n < 1 {
+			return errors.New("param 'limit' must be a positive integer")
+		}
+		limit = int(n)
+	}
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total || end < offset {
+		end = total
+	}
+	page := &Page{Items: rv.Slice(offset, end).Interface(), Total: total, Offset: offset}
+	if end < total {
+		page.NextOffset = &end
+	}
+	resp.Result = page
+	return nil
+}
+
+// transformResult runs the configured result transforms over v
+func (s *Server) transformResult(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	for _, t := range s.resultTransforms {
+		v = t(v)
+	}
+	return v
+}
+
+// roundFloatsIn rounds every float64 inside v to n decimal places
+func roundFloatsIn(v interface{}, n int) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if !strings.ContainsAny(string(t), ".eE") {
+			return t
+		}
+		if f, err := t.Float64(); err == nil {
+			return roundFloatsIn(f, n)
+		}
+	case float64:
+		p := math.Pow(10, float64(n))
+		return math.Round(t*p) / p
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			out[k] = roundFloatsIn(e, n)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			out[i] = roundFloatsIn(e, n)
+		}
+		return out
+	}
+	return v
+}
+
+// snakeCaseKeys rewrites object keys inside v to snake_case
+func snakeCaseKeys(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			out[toSnakeCase(k)] = snakeCaseKeys(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			out[i] = snakeCaseKeys(e)
+		}
+		return out
+	}
+	return v
+}
+
+// toSnakeCase converts camelCase, PascalCase and kebab-case to snake_case
+func toSnakeCase(s string) string {
+	var b strings.Builder
+	r := []rune(s)
+	for i, c := range r {
+		switch {
+		case c == '-' || c == ' ':
+			b.WriteRune('_')
+		case c >= 'A' && c <= 'Z':
+			// start a new word unless we're inside an acronym like "ID"
+			if i > 0 && r[i-1] != '_' && r[i-1] != '-' && (r[i-1] < 'A' || r[i-1] > 'Z' || (i+1 < len(r) && r[i+1] >= 'a' && r[i+1] <= 'z')) {
+				b.WriteRune('_')
+			}
+			b.WriteRune(c + ('a' - 'A'))
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// applyNumberMode rewrites every number inside a result according to mode:
+// "int" emits whole values as integers, "float" always emits a decimal point,
+// and "string" emits numbers as JSON strings to preserve them exactly
+func applyNumberMode(v interface{}, mode string) interface{} {
+	switch t := v.(type) {
+	case int:
+		return formatInt(int64(t), mode)
+	case int64:
+		return formatInt(t, mode)
+	case json.Number:
+		// decoded params, e.g. echoed back: integers stay exact
+		if n, err := t.Int64(); err == nil {
+			return formatInt(n, mode)
+		}
+		if !strings.ContainsAny(string(t), ".eE") {
+			// an integer beyond int64: keep the digits as sent
+			switch mode {
+			case "float":
+				return t + ".0"
+			case "string":
+				return string(t)
+			}
+			return t
+		}
+		if f, err := t.Float64(); err == nil {
+			return formatFloat(f, mode)
+		}
+	case float64:
+		return formatFloat(t, mode)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			out[k] = applyNumberMode(e, mode)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			out[i] = applyNumberMode(e, mode)
+		}
+		return out
+	}
+	return v
+}
+
+func formatInt(n int64, mode string) interface{} {
+	switch mode {
+	case "float":
+		return json.Number(strconv.FormatInt(n, 10) + ".0")
+	case "string":
+		return strconv.FormatInt(n, 10)
+	}
+	return n
+}
+
+func formatFloat(f float64, mode string) interface{} {
+	switch mode {
+	case "float":
+		s := strconv.FormatFloat(f, 'f', -1, 64)
+		if !strings.ContainsAny(s, ".eE") {
+			s += ".0"
+		}
+		return json.Number(s)
+	case "string":
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	// only whole values that a float64 represents exactly
+	if f == math.Trunc(f) && math.Abs(f) <= 1<<53 {
+		return int64(f)
+	}
+	return f
+}
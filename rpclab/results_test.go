@@ -0,0 +1,147 @@
+package rpclab
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestJSONNumberMode(t *testing.T) {
+	tests := []struct {
+		mode   string
+		method string
+		params string
+		want   string // the raw result
+	}{
+		{"int", "add", `{"a":2,"b":3}`, `5`},
+		{"float", "add", `{"a":2,"b":3}`, `5.0`},
+		{"string", "add", `{"a":2,"b":3}`, `"5"`},
+		{"int", "divide", `{"a":7,"b":2}`, `3.5`},
+		{"float", "divide", `{"a":7,"b":2}`, `3.5`},
+		{"string", "divide", `{"a":7,"b":2}`, `"3.5"`},
+		{"int", "multiply", `{"a":4,"b":3}`, `12`},
+		{"string", "multiply", `{"a":9007199254740993,"b":1}`, `"9007199254740993"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.method, func(t *testing.T) {
+			_, addr := startServer(t, func(cfg *Config) { cfg.JSONNumberMode = tt.mode })
+			msg := rawCall(t, addr, `{"request_id":"1","method":"`+tt.method+`","params":`+tt.params+`}`)
+			var resp struct {
+				Result json.RawMessage `json:"result"`
+			}
+			if err := json.Unmarshal(msg, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if string(resp.Result) != tt.want {
+				t.Errorf("result = %s, want %s in -json-number-mode %s", resp.Result, tt.want, tt.mode)
+			}
+		})
+	}
+}
+
+func TestRoundFloats(t *testing.T) {
+	tests := []struct {
+		name   string
+		digits int
+		in     interface{}
+		want   string
+	}{
+		{"float", 2, 3.14159, "3.14"},
+		{"rounds half away from zero", 1, 0.25, "0.3"},
+		{"no decimals", 0, 2.5, "3"},
+		{"decoded number", 3, json.Number("1.23456"), "1.235"},
+		{"integers untouched", 2, json.Number("12345678901234567"), "12345678901234567"},
+		{"nested", 1, map[string]interface{}{"l": []interface{}{1.26, "x"}}, "map[l:[1.3 x]]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fmt.Sprint(roundFloatsIn(tt.in, tt.digits)); got != tt.want {
+				t.Errorf("roundFloatsIn(%v, %d) = %s, want %s", tt.in, tt.digits, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResultTransforms(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) {
+		cfg.RoundFloats = 2
+		cfg.SnakeCaseKeys = true
+	})
+	tests := []struct {
+		method string
+		params string
+		want   string
+	}{
+		{"divide", `{"a":10,"b":3}`, `3.33`},
+		{"echo", `{"someValue":1.23456,"kebab-key":"x"}`, `{"kebab_key":"x","some_value":1.23}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			msg := rawCall(t, addr, `{"request_id":"1","method":"`+tt.method+`","params":`+tt.params+`}`)
+			var resp struct {
+				Result json.RawMessage `json:"result"`
+			}
+			if err := json.Unmarshal(msg, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if string(resp.Result) != tt.want {
+				t.Errorf("result = %s, want %s", resp.Result, tt.want)
+			}
+		})
+	}
+}
+
+func TestResultPaging(t *testing.T) {
+	_, addr := startServer(t, nil)
+	tests := []struct {
+		name      string
+		params    map[string]interface{}
+		items     int
+		offset    int
+		next      interface{} // nil on the last page
+		errSubstr string
+	}{
+		{"first page", map[string]interface{}{"limit": 10}, 10, 0, "10", ""},
+		{"middle page", map[string]interface{}{"limit": 10, "offset": 10}, 10, 10, "20", ""},
+		{"last page", map[string]interface{}{"limit": 10, "offset": 20}, 5, 20, nil, ""},
+		{"offset only", map[string]interface{}{"offset": 22}, 3, 22, nil, ""},
+		{"past the end", map[string]interface{}{"limit": 10, "offset": 99}, 0, 25, nil, ""},
+		{"zero limit", map[string]interface{}{"limit": 0}, 0, 0, nil, "'limit' must be a positive integer"},
+		{"negative offset", map[string]interface{}{"offset": -1}, 0, 0, nil, "'offset' must be a non-negative integer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := map[string]interface{}{"count": 25}
+			for k, v := range tt.params {
+				params[k] = v
+			}
+			resp := call(t, addr, "ulid", params)
+			if tt.errSubstr != "" {
+				if resp.Code != ErrBadParams || !strings.Contains(resp.Error, tt.errSubstr) {
+					t.Fatalf("got %s %q (%s), want bad_params %q", resp.Status, resp.Error, resp.Code, tt.errSubstr)
+				}
+				return
+			}
+			page, ok := resp.Result.(map[string]interface{})
+			if !ok {
+				t.Fatalf("result = %#v, want a page", resp.Result)
+			}
+			items, _ := page["items"].([]interface{})
+			if len(items) != tt.items || fmt.Sprint(page["total"]) != "25" || fmt.Sprint(page["offset"]) != fmt.Sprint(tt.offset) {
+				t.Errorf("got %d items, total %v, offset %v; want %d, 25, %d", len(items), page["total"], page["offset"], tt.items, tt.offset)
+			}
+			if fmt.Sprint(page["next_offset"]) != fmt.Sprint(tt.next) {
+				t.Errorf("next_offset = %v, want %v", page["next_offset"], tt.next)
+			}
+		})
+	}
+
+	t.Run("off", func(t *testing.T) {
+		_, addr := startServer(t, func(cfg *Config) { cfg.ResultPaging = false })
+		resp := call(t, addr, "ulid", map[string]interface{}{"count": 25, "limit": 10})
+		if items, ok := resp.Result.([]interface{}); !ok || len(items) != 25 {
+			t.Errorf("result = %#v, want all 25 ulids unpaged", resp.Result)
+		}
+	})
+}
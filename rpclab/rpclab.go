@@ -0,0 +1,103 @@
+// Package rpclab is a small JSON-over-TCP RPC server and client for
+// experimenting with failure modes: timeouts, retries, crashes, overload and
+// malformed traffic. The rpc-server and rpc-client commands (server.go and
+// client.go at the repository root) are thin command-line wrappers around it.
+package rpclab
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Message types
+type Request struct {
+	RequestID string                 `json:"request_id"`
+	Method    string                 `json:"method"`
+	Params    map[string]interface{} `json:"params"`
+	Timestamp string                 `json:"timestamp,omitempty"`
+	Oneway    bool                   `json:"oneway,omitempty"`  // fire-and-forget: no response is sent
+	Attempt   int                    `json:"attempt,omitempty"` // client's retry counter, echoed back
+	AuthToken string                 `json:"auth_token,omitempty"`
+	TraceID   string                 `json:"trace_id,omitempty"` // the caller's trace; the server logs a child span
+	SpanID    string                 `json:"span_id,omitempty"`  // the caller's span, parent of the server's
+}
+
+type Response struct {
+	RequestID string      `json:"request_id"`
+	Result    interface{} `json:"result,omitempty"`
+	Status    string      `json:"status"` // "OK" or "ERROR"; "GOODBYE" for an idle close, see -graceful-close-on-idle
+	Error     string      `json:"error,omitempty"`
+	Code      string      `json:"code,omitempty"`     // machine-readable error class, set with Error
+	Attempt   int         `json:"attempt,omitempty"`  // the request's attempt, so retries can be told apart
+	Checksum  string      `json:"checksum,omitempty"` // "<algo>:<hex>" over the serialized result
+	Timings   *Timings    `json:"timings,omitempty"`
+	// with a transient error: how long the client should wait before retrying
+	RetryAfterMs int64 `json:"retry_after_ms,omitempty"`
+	// time spent running the method, excluding queueing and I/O
+	DurationMs float64 `json:"duration_ms,omitempty"`
+	// the server closes the connection after this response; reconnect for more
+	Close bool `json:"close,omitempty"`
+	// the request's trace_id, for correlating on the client
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// error codes carried in Response.Code so callers don't have to parse Error
+const (
+	ErrBadRequest       = "bad_request"       // undecodable or invalid request envelope
+	ErrUnknownMethod    = "unknown_method"    // no such method
+	ErrBadParams        = "bad_params"        // missing or invalid params
+	ErrMethodDisabled   = "method_disabled"   // method turned off with -disable-methods, or off by default and not enabled
+	ErrUnavailable      = "unavailable"       // server quiesced or out of capacity; safe to retry later
+	ErrNotReady         = "not_ready"         // server still in its -warmup period
+	ErrServerBusy       = "server_busy"       // connection refused by -max-concurrent
+	ErrRateLimited      = "rate_limited"      // client IP exceeded -rate
+	ErrDeadlineExceeded = "deadline_exceeded" // request deadline passed before it finished
+	ErrResourceLimit    = "resource_limit"    // request or response exceeded a size/memory limit
+	ErrRequestTooLarge  = "request_too_large" // request exceeded -max-request-bytes; the connection is closed
+	ErrReadTimeout      = "read_timeout"      // request not received within -read-timeout; the connection is closed
+	ErrMethodTimeout    = "method_timeout"    // handler ran past its -method-timeout budget
+	ErrUnauthorized     = "unauthorized"      // auth_token missing or not the server's -auth-token
+	ErrMalformedStream  = "malformed_stream"  // extra bytes after the request in a frame, datagram or -strict connection
+	ErrInternal         = "internal"          // unexpected server failure
+)
+
+// Timings breaks a request's server-side latency into stages (milliseconds)
+type Timings struct {
+	DecodeMs  float64 `json:"decode_ms"`
+	QueueMs   float64 `json:"queue_ms"`
+	HandlerMs float64 `json:"handler_ms"`
+	EncodeMs  float64 `json:"encode_ms"`
+	TotalMs   float64 `json:"total_ms"`
+}
+
+// DecodeJSON is json.Unmarshal with numbers kept as json.Number, so
+// integers beyond 2^53 survive the round trip exactly
+func DecodeJSON(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid character after top-level value")
+	}
+	return nil
+}
+
+// NewRequestID returns a random v4-style UUID, the default request id
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	// set version to 4
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x",
+		b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,1553 @@
+package rpclab
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Clock is the server's source of time; tests and demos can pin it.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// fixedClock always returns the same instant
+type fixedClock struct{ t time.Time }
+
+func (c fixedClock) Now() time.Time { return c.t }
+
+// ParseClockSource maps the -server-clock-source flag to a Clock:
+// "system" for real time or an RFC3339 timestamp for a pinned clock
+func ParseClockSource(src string) (Clock, error) {
+	if src == "" || strings.EqualFold(src, "system") {
+		return systemClock{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, src)
+	if err != nil {
+		return nil, fmt.Errorf("clock source must be 'system' or an RFC3339 time: %v", err)
+	}
+	return fixedClock{t: t}, nil
+}
+
+// Config holds every server setting. The fields mirror the command-line flags
+// (named in the comments, whose usage text documents them), and -config files
+// use the flag names as keys. Zero limits mean unlimited.
+type Config struct {
+	Port      int    // -port
+	Addr      string // -addr
+	Transport string // -transport: "tcp" or "udp"
+	Protocol  string // -protocol: "native" or "jsonrpc2"
+	Clock     Clock  // -server-clock-source; nil means the system clock
+
+	TLSCert          string        // -tls-cert
+	TLSKey           string        // -tls-key
+	TLSReload        bool          // -tls-reload
+	HandshakeTimeout time.Duration // -handshake-timeout
+	BindRetries      int           // -bind-retries
+	BindRetryDelay   time.Duration // -bind-retry-delay
+
+	Framing         string // -framing: "json" or "length"
+	MaxFrameSize    int    // -max-frame-size
+	MaxRequestBytes int64  // -max-request-bytes
+	Strict          bool   // -strict
+
+	MaxDecompressedBytes int64 // -max-decompressed-bytes
+	MaxCompressionRatio  int64 // -max-compression-ratio
+
+	AuthToken          string        // -auth-token
+	RequireTimestamp   bool          // -require-timestamp
+	MaxClockSkew       time.Duration // -max-clock-skew
+	MaxClockSkewAction string        // -max-clock-skew-action: "reject" or "warn"
+	MaxParamsKeys      int           // -max-params-keys
+	MaxStringLen       int           // -max-string-len
+	MaxSleep           time.Duration // -max-sleep
+	MaxRequestMemory   uint64        // -max-request-memory
+
+	ReadTimeout         time.Duration // -read-timeout
+	GracefulCloseOnIdle bool          // -graceful-close-on-idle
+	WriteRate           int           // -write-rate
+	MaxRequestsPerConn  int           // -max-requests-per-conn
+
+	EnableCrash          bool                              // -enable-crash, same as enabling sleep_then_crash
+	EnableReflection     bool                              // -enable-reflection, same as enabling reflect
+	EnableMethods        []string                          // -enable-methods
+	DisableMethods       []string                          // -disable-methods
+	DefaultParams        map[string]map[string]interface{} // -default-params, by lowercased method
+	MethodTimeouts       map[string]time.Duration          // -method-timeout
+	DefaultMethodTimeout time.Duration                     // -default-method-timeout
+	MethodCallBudget     int                               // -method-call-budget
+	MethodCosts          map[string]int                    // -method-cost
+
+	JSONNumberMode   string // -json-number-mode: "int", "float" or "string"
+	ResponseChecksum string // -response-checksum: "", "crc32" or "sha256"
+	RoundFloats      int    // -round-floats (-1 = off)
+	SnakeCaseKeys    bool   // -snake-case-keys
+	ResultPaging     bool   // -result-paging
+	TimingDetail     bool   // -timing-detail
+	NoTiming         bool   // -no-timing
+
+	LogSlowestRequests int           // -log-slowest-requests
+	RetryWindow        time.Duration // -retry-window
+	IdempotencyTTL     time.Duration // -idempotency-ttl
+	IdempotencySize    int           // -idempotency-size
+	LogFile            string        // -log-file
+	MetricsAddr        string        // -metrics-addr
+	Debug              bool          // -debug
+
+	Warmup          time.Duration // -warmup
+	ShutdownTimeout time.Duration // -shutdown-timeout
+
+	MaxActiveRequests      int           // -max-active-requests
+	MaxAcceptRate          float64       // -max-accept-rate
+	Banlist                string        // -banlist
+	MaxConcurrent          int           // -max-concurrent
+	MaxConcurrentMode      string        // -max-concurrent-mode: "reject" or "queue"
+	MaxConcurrentQueueWait time.Duration // -max-concurrent-queue-wait
+	Workers                int           // -workers
+	WorkerQueue            int           // -worker-queue
+	WorkerQueuePolicy      string        // -worker-queue-policy: "reject" or "drop"
+	Rate                   float64       // -rate
+	Burst                  int           // -burst
+	MaxConnsPerIP          int           // -max-conns-per-ip
+	SlowMethods            []string      // -slow-methods
+	SlowWorkers            int           // -slow-workers
+	MaxQueueWait           time.Duration // -max-queue-wait
+}
+
+// DefaultConfig returns the settings the server runs with when no flags are given
+func DefaultConfig() Config {
+	return Config{
+		Port:                   5000,
+		Addr:                   "0.0.0.0",
+		Transport:              "tcp",
+		Protocol:               "native",
+		Clock:                  systemClock{},
+		HandshakeTimeout:       10 * time.Second,
+		BindRetryDelay:         500 * time.Millisecond,
+		Framing:                "json",
+		MaxFrameSize:           1 << 20,
+		MaxRequestBytes:        1 << 20,
+		MaxDecompressedBytes:   8 << 20,
+		MaxCompressionRatio:    100,
+		MaxClockSkewAction:     "reject",
+		MaxSleep:               time.Minute,
+		DefaultParams:          map[string]map[string]interface{}{},
+		MethodTimeouts:         map[string]time.Duration{},
+		DefaultMethodTimeout:   time.Minute + 10*time.Second, // past MaxSleep, so the longest allowed sleep finishes
+		MethodCosts:            map[string]int{},
+		JSONNumberMode:         "int",
+		RoundFloats:            -1,
+		ResultPaging:           true,
+		LogSlowestRequests:     10,
+		RetryWindow:            5 * time.Minute,
+		IdempotencySize:        10000,
+		ShutdownTimeout:        10 * time.Second,
+		MaxConcurrentMode:      "reject",
+		MaxConcurrentQueueWait: time.Second,
+		WorkerQueue:            64,
+		WorkerQueuePolicy:      "reject",
+		SlowMethods:            []string{"slow"},
+	}
+}
+
+// Server is a configured RPC server and its runtime state
+type Server struct {
+	cfg       Config
+	clock     Clock
+	tlsConfig *tls.Config   // nil for plaintext
+	certs     *certReloader // nil unless -tls-reload
+	bans      *banlist      // nil = no banlist
+
+	// exit terminates the process for the crash methods; swappable so the
+	// crash paths can be exercised without killing the caller
+	exit func(int)
+
+	// lowercased method names to their implementation, the ones refused
+	// with ErrMethodDisabled, those routed to slowPool, and handler budgets
+	handlers        map[string]Handler
+	disabledMethods map[string]bool
+	slowMethods     map[string]bool
+	methodTimeouts  map[string]time.Duration
+	methodCosts     map[string]int
+
+	// resultTransforms post-process Response.Result, in order, before it is encoded
+	resultTransforms []func(interface{}) interface{}
+
+	// activeSlots bounds concurrently executing requests across all
+	// connections (nil = unlimited); slowPool is the dedicated worker pool
+	// for slow methods (nil when disabled)
+	activeSlots chan struct{}
+	slowPool    *workerPool
+
+	slowest     *slowestTracker
+	stats       *serverStats
+	retries     *retryTracker
+	idempotency *idempotencyCache // nil = off
+	rateLimiter *ipRateLimiter    // nil = off
+	audit       *auditLog         // nil = off
+
+	// quiesced servers keep the listener open but reject new work; inFlight
+	// counts requests currently being dispatched
+	quiesced atomic.Bool
+	inFlight atomic.Int64
+
+	// until readyAt only ping is answered; everything else gets ErrNotReady
+	readyAt time.Time
+
+	// set once Shutdown is called; connections then finish their current
+	// request and close instead of waiting for more
+	shuttingDown atomic.Bool
+	conns        *connTracker
+	udpActive    sync.WaitGroup
+
+	mu sync.Mutex
+	ln net.Listener   // set by Serve, closed by Shutdown
+	pc net.PacketConn // set by ServeUDP, closed by Shutdown
+}
+
+// NewServer validates cfg and prepares a server. Files named in cfg (TLS key
+// pair, banlist, request log) are loaded here, so a bad one never leaves a
+// half-started server holding the port.
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.Framing != "json" && cfg.Framing != "length" {
+		return nil, fmt.Errorf("invalid -framing %q (want json|length)", cfg.Framing)
+	}
+	if cfg.Protocol != "native" && cfg.Protocol != "jsonrpc2" {
+		return nil, fmt.Errorf("invalid -protocol %q (want native|jsonrpc2)", cfg.Protocol)
+	}
+	if cfg.Transport != "tcp" && cfg.Transport != "udp" {
+		return nil, fmt.Errorf("invalid -transport %q (want tcp|udp)", cfg.Transport)
+	}
+	if cfg.WorkerQueuePolicy != "reject" && cfg.WorkerQueuePolicy != "drop" {
+		return nil, fmt.Errorf("invalid -worker-queue-policy %q (want reject|drop)", cfg.WorkerQueuePolicy)
+	}
+	if cfg.Workers > 0 && cfg.WorkerQueue < 0 {
+		return nil, errors.New("-worker-queue must not be negative")
+	}
+	if cfg.MaxConcurrentMode != "reject" && cfg.MaxConcurrentMode != "queue" {
+		return nil, fmt.Errorf("invalid -max-concurrent-mode %q (want reject|queue)", cfg.MaxConcurrentMode)
+	}
+	if cfg.GracefulCloseOnIdle && cfg.ReadTimeout <= 0 {
+		return nil, errors.New("-graceful-close-on-idle needs -read-timeout")
+	}
+	if cfg.GracefulCloseOnIdle && cfg.Protocol == "jsonrpc2" {
+		return nil, errors.New("-graceful-close-on-idle is not supported with -protocol jsonrpc2")
+	}
+	if cfg.MaxClockSkewAction != "reject" && cfg.MaxClockSkewAction != "warn" {
+		return nil, fmt.Errorf("invalid -max-clock-skew-action %q (want reject|warn)", cfg.MaxClockSkewAction)
+	}
+	switch cfg.ResponseChecksum {
+	case "", "crc32", "sha256":
+	default:
+		return nil, fmt.Errorf("invalid -response-checksum %q (want crc32|sha256)", cfg.ResponseChecksum)
+	}
+	switch cfg.JSONNumberMode {
+	case "int", "float", "string":
+	default:
+		return nil, fmt.Errorf("invalid -json-number-mode %q (want int|float|string)", cfg.JSONNumberMode)
+	}
+
+	s := &Server{
+		cfg:   cfg,
+		clock: cfg.Clock,
+		exit:  os.Exit,
+		// the crash methods, sleep_random and reflect stay off unless
+		// named in -enable-methods (or enabled by their older flags)
+		disabledMethods: map[string]bool{"crash": true, "sleep_then_crash": true, "sleep_random": true, "reflect": true},
+		slowMethods:     map[string]bool{},
+		methodTimeouts:  map[string]time.Duration{},
+		methodCosts:     map[string]int{},
+		stats:           newServerStats(),
+		readyAt:         time.Now().Add(cfg.Warmup),
+	}
+	if s.clock == nil {
+		s.clock = systemClock{}
+	}
+	s.conns = newConnTracker(&s.shuttingDown)
+	s.slowest = &slowestTracker{n: cfg.LogSlowestRequests, clock: s.clock}
+	s.retries = &retryTracker{window: cfg.RetryWindow, clock: s.clock, seen: map[string]*seenID{}}
+	s.handlers = s.methodHandlers()
+	if cfg.Protocol == "jsonrpc2" {
+		s.handlers[jsonrpcInvalid] = handleInvalidJSONRPC
+	}
+	enable := cfg.EnableMethods
+	if cfg.EnableCrash {
+		enable = append(enable[:len(enable):len(enable)], "sleep_then_crash")
+	}
+	if cfg.EnableReflection {
+		enable = append(enable[:len(enable):len(enable)], "reflect")
+	}
+	if err := s.configureMethods(enable, cfg.DisableMethods); err != nil {
+		return nil, err
+	}
+	for _, m := range cfg.SlowMethods {
+		s.slowMethods[strings.ToLower(m)] = true
+	}
+	for name, d := range cfg.MethodTimeouts {
+		name = strings.ToLower(name)
+		if !KnownMethod(name) {
+			return nil, fmt.Errorf("-method-timeout: unknown method %q", name)
+		}
+		s.methodTimeouts[name] = d
+	}
+	for name, cost := range cfg.MethodCosts {
+		name = strings.ToLower(name)
+		if !KnownMethod(name) {
+			return nil, fmt.Errorf("-method-cost: unknown method %q", name)
+		}
+		if cost < 0 {
+			return nil, fmt.Errorf("-method-cost: negative cost for %s", name)
+		}
+		s.methodCosts[name] = cost
+	}
+	if cfg.Rate > 0 {
+		s.rateLimiter = newIPRateLimiter(cfg.Rate, cfg.Burst)
+		go s.rateLimiter.sweepLoop(time.Minute)
+	}
+	if cfg.IdempotencyTTL > 0 {
+		s.idempotency = newIdempotencyCache(cfg.IdempotencyTTL, cfg.IdempotencySize)
+	}
+	if cfg.MaxActiveRequests > 0 {
+		s.activeSlots = make(chan struct{}, cfg.MaxActiveRequests)
+	}
+	if cfg.RoundFloats >= 0 {
+		n := cfg.RoundFloats
+		s.resultTransforms = append(s.resultTransforms, func(v interface{}) interface{} { return roundFloatsIn(v, n) })
+	}
+	if cfg.SnakeCaseKeys {
+		s.resultTransforms = append(s.resultTransforms, snakeCaseKeys)
+	}
+	// number encoding runs last since it turns numbers into json.Number/strings
+	mode := cfg.JSONNumberMode
+	s.resultTransforms = append(s.resultTransforms, func(v interface{}) interface{} { return applyNumberMode(v, mode) })
+
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		if cfg.TLSCert == "" || cfg.TLSKey == "" {
+			return nil, errors.New("-tls-cert and -tls-key must be given together")
+		}
+		if cfg.Transport == "udp" {
+			return nil, errors.New("TLS is not supported with -transport udp")
+		}
+		certs := &certReloader{certFile: cfg.TLSCert, keyFile: cfg.TLSKey}
+		if err := certs.reload(); err != nil {
+			return nil, fmt.Errorf("failed to load TLS key pair (cert %s, key %s): %v", cfg.TLSCert, cfg.TLSKey, err)
+		}
+		if cfg.TLSReload {
+			s.certs = certs
+			s.tlsConfig = &tls.Config{GetCertificate: certs.get, MinVersion: tls.VersionTLS12}
+			go certs.watch(certReloadInterval)
+		} else {
+			s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{*certs.cert}, MinVersion: tls.VersionTLS12}
+		}
+	} else if cfg.TLSReload {
+		return nil, errors.New("-tls-reload needs -tls-cert and -tls-key")
+	}
+	if cfg.Banlist != "" {
+		bans, err := loadBanlist(cfg.Banlist)
+		if err != nil {
+			return nil, fmt.Errorf("banlist: %v", err)
+		}
+		s.bans = bans
+		go bans.watch(banlistReloadInterval)
+	}
+	if cfg.LogFile != "" {
+		a, err := openAuditLog(cfg.LogFile)
+		if err != nil {
+			return nil, fmt.Errorf("log file: %v", err)
+		}
+		s.audit = a
+	}
+	if cfg.SlowWorkers > 0 {
+		s.slowPool = newWorkerPool(cfg.SlowWorkers, cfg.MaxQueueWait, func(ctx context.Context, req *Request) *Response {
+			return s.runWithMemoryLimit(ctx, req, cfg.MaxRequestMemory)
+		})
+		log.Printf("Slow methods %s use a pool of %d workers", strings.Join(cfg.SlowMethods, ","), cfg.SlowWorkers)
+	}
+	return s, nil
+}
+
+// listenAddr is the -addr and -port host:port to bind; JoinHostPort brackets
+// IPv6 literals, and ones already bracketed are accepted too
+func (s *Server) listenAddr() string {
+	return net.JoinHostPort(strings.Trim(s.cfg.Addr, "[]"), strconv.Itoa(s.cfg.Port))
+}
+
+// ListenAndServe binds the configured address over the configured transport,
+// plus the metrics endpoint if one is set, and serves until Shutdown
+func (s *Server) ListenAndServe() error {
+	if s.cfg.MetricsAddr != "" {
+		mln, err := net.Listen("tcp", s.cfg.MetricsAddr)
+		if err != nil {
+			return fmt.Errorf("metrics listen error: %v", err)
+		}
+		log.Printf("Serving metrics on http://%s/metrics", mln.Addr())
+		go s.serveMetrics(mln)
+	}
+
+	listenAddr := s.listenAddr()
+	if s.cfg.Transport == "udp" {
+		log.Printf("Starting RPC server on %s (udp)", listenAddr)
+		pc, err := net.ListenPacket("udp", listenAddr)
+		if err != nil {
+			return fmt.Errorf("listen error: %v", err)
+		}
+		return s.ServeUDP(pc)
+	}
+	log.Printf("Starting RPC server on %s", listenAddr)
+	ln, err := listenWithRetry(listenAddr, s.cfg.BindRetries, s.cfg.BindRetryDelay)
+	if err != nil {
+		return fmt.Errorf("listen error: %v", err)
+	}
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(ln, s.tlsConfig)
+		log.Printf("TLS enabled with certificate %s", s.cfg.TLSCert)
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until Shutdown closes it, which makes it
+// return nil
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	defer ln.Close()
+	if s.shuttingDown.Load() {
+		return nil
+	}
+
+	perIP := newIPConnLimiter(s.cfg.MaxConnsPerIP)
+	var queueWait time.Duration
+	if s.cfg.MaxConcurrentMode == "queue" {
+		queueWait = s.cfg.MaxConcurrentQueueWait
+	}
+	serving := newConnSemaphore(s.cfg.MaxConcurrent, queueWait)
+
+	// serveConn runs a tracked connection to completion
+	serveConn := func(conn net.Conn, ip net.IP) {
+		defer s.conns.done(conn)
+		defer perIP.release(ip)
+		if !serving.acquire() {
+			log.Printf("[%s] refused: %d connections already being served", conn.RemoteAddr(), serving.max())
+			sendError(s.newCodec(conn, conn), "", ErrServerBusy, "server busy")
+			conn.Close()
+			return
+		}
+		// deferred so the slot is returned even if handleConn panics
+		defer serving.release()
+		s.handleConn(conn)
+	}
+	var queue chan acceptedConn
+	if s.cfg.Workers > 0 {
+		queue = make(chan acceptedConn, s.cfg.WorkerQueue)
+		// no more sends once the accept loop is done, so workers can drain and exit
+		defer close(queue)
+		for i := 0; i < s.cfg.Workers; i++ {
+			go func() {
+				for ac := range queue {
+					serveConn(ac.conn, ac.ip)
+				}
+			}()
+		}
+		log.Printf("Serving connections on %d workers (queue %d, %s when full)", s.cfg.Workers, s.cfg.WorkerQueue, s.cfg.WorkerQueuePolicy)
+	}
+
+	throttle := newAcceptThrottle(s.cfg.MaxAcceptRate)
+	for {
+		throttle.wait()
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.shuttingDown.Load() {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("accept error: %v", err)
+			continue
+		}
+		ip := remoteIP(conn)
+		if s.bans != nil && s.bans.banned(ip) {
+			log.Printf("[%s] refused: banned address", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		if !perIP.acquire(ip) {
+			log.Printf("[%s] refused: too many connections from %s", conn.RemoteAddr(), ip)
+			conn.Close()
+			continue
+		}
+		s.conns.add(conn)
+		if queue == nil {
+			go serveConn(conn, ip)
+			continue
+		}
+		select {
+		case queue <- acceptedConn{conn, ip}:
+		default:
+			s.refuseQueued(conn)
+			perIP.release(ip)
+			s.conns.done(conn)
+		}
+	}
+}
+
+// Shutdown stops accepting new work, lets active connections finish their
+// current request within the shutdown timeout and closes the request log.
+// It reports whether everything finished in time.
+func (s *Server) Shutdown() bool {
+	s.shuttingDown.Store(true)
+	s.mu.Lock()
+	ln, pc := s.ln, s.pc
+	s.mu.Unlock()
+	drained := true
+	if ln != nil {
+		ln.Close()
+		if !s.conns.drain(s.cfg.ShutdownTimeout) {
+			log.Printf("Shutdown timeout: %d connections still active", s.conns.active())
+			drained = false
+		}
+	}
+	if pc != nil {
+		pc.Close()
+		if !waitTimeout(&s.udpActive, s.cfg.ShutdownTimeout) {
+			log.Printf("Shutdown timeout: udp requests still active")
+			drained = false
+		}
+	}
+	if s.audit != nil {
+		if err := s.audit.close(); err != nil {
+			log.Printf("log file: %v", err)
+		}
+	}
+	if drained {
+		log.Printf("Shutdown complete")
+	}
+	return drained
+}
+
+// Quiesced reports whether the server is quiesced
+func (s *Server) Quiesced() bool {
+	return s.quiesced.Load()
+}
+
+// acceptedConn is a connection waiting in the -workers queue
+type acceptedConn struct {
+	conn net.Conn
+	ip   net.IP
+}
+
+// I/O budget for the server_busy reply to a connection the full worker
+// queue turned away, so a slow client can't stall the accept loop
+const refuseWriteTimeout = 100 * time.Millisecond
+
+// refuseQueued closes a connection the full worker queue has no room for,
+// first answering server_busy under the reject policy
+func (s *Server) refuseQueued(conn net.Conn) {
+	if s.cfg.WorkerQueuePolicy == "reject" {
+		log.Printf("[%s] refused: worker queue full", conn.RemoteAddr())
+		conn.SetDeadline(time.Now().Add(refuseWriteTimeout))
+		sendError(s.newCodec(conn, conn), "", ErrServerBusy, "server busy")
+	} else {
+		s.debugf("[%s] dropped: worker queue full", conn.RemoteAddr())
+	}
+	conn.Close()
+}
+
+// connTracker keeps track of live connections so shutdown can wait for them
+type connTracker struct {
+	wg           sync.WaitGroup
+	mu           sync.Mutex
+	conns        map[net.Conn]struct{}
+	shuttingDown *atomic.Bool
+}
+
+func newConnTracker(shuttingDown *atomic.Bool) *connTracker {
+	return &connTracker{conns: map[net.Conn]struct{}{}, shuttingDown: shuttingDown}
+}
+
+func (t *connTracker) add(conn net.Conn) {
+	t.wg.Add(1)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[conn] = struct{}{}
+	if t.shuttingDown.Load() {
+		// accepted just before the listener closed; drain() may have missed it
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+func (t *connTracker) done(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+func (t *connTracker) active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// drain wakes connections blocked reading their next request so they close,
+// then waits up to timeout for in-flight requests to be answered. It reports
+// whether every connection finished in time.
+func (t *connTracker) drain(timeout time.Duration) bool {
+	t.mu.Lock()
+	for conn := range t.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	t.mu.Unlock()
+	return waitTimeout(&t.wg, timeout)
+}
+
+// waitTimeout waits for wg up to timeout and reports whether it finished
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// ServeUDP treats each datagram as one request (or batch) and answers with a
+// single datagram to the sender. UDP gives no delivery or ordering guarantees:
+// lost requests or replies simply time out on the client, and replies too big
+// for one datagram are replaced by a "response too large" error.
+func (s *Server) ServeUDP(pc net.PacketConn) error {
+	s.mu.Lock()
+	s.pc = pc
+	s.mu.Unlock()
+	defer pc.Close()
+	if s.shuttingDown.Load() {
+		return nil
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if s.shuttingDown.Load() {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("read error: %v", err)
+			continue
+		}
+		msg := append([]byte(nil), buf[:n]...)
+		if ua, ok := addr.(*net.UDPAddr); ok && s.bans != nil && s.bans.banned(ua.IP) {
+			log.Printf("[%s] dropped datagram: banned address", addr)
+			continue
+		}
+		at := arrivedNow()
+		s.udpActive.Add(1)
+		go func() {
+			defer s.udpActive.Done()
+			s.serveDatagram(pc, addr, msg, at)
+		}()
+	}
+}
+
+func (s *Server) serveDatagram(pc net.PacketConn, addr net.Addr, msg []byte, at arrival) {
+	remote := addr.String()
+	codec := s.withProtocol(&packetCodec{pc: pc, addr: addr})
+	var current *Request
+	defer recoverPanic(remote, codec, &current)
+	if ua, ok := addr.(*net.UDPAddr); ok && s.rateLimiter != nil {
+		if ok, wait := s.rateLimiter.allow(ua.IP); !ok {
+			log.Printf("[%s] rate limited", remote)
+			sendRateLimited(codec, wait)
+			return
+		}
+	}
+	if hasTrailingData(msg) {
+		log.Printf("[%s] trailing data in datagram", remote)
+		sendError(codec, "", ErrMalformedStream, "trailing data after request")
+		return
+	}
+	if isBatch(msg) {
+		s.serveBatch(codec, remote, msg, at, false)
+		return
+	}
+	var req Request
+	if err := DecodeJSON(msg, &req); err != nil {
+		log.Printf("[%s] invalid request: %v", remote, err)
+		sendError(codec, "", ErrBadRequest, "invalid json")
+		return
+	}
+	current = &req
+	s.serveRequest(nil, codec, remote, &req, at, false)
+}
+
+// listenWithRetry retries net.Listen so a quick restart doesn't fail while the
+// previous process still holds the port. Go already sets SO_REUSEADDR on unix
+// listeners, so sockets in TIME_WAIT don't block the bind.
+func listenWithRetry(addr string, retries int, delay time.Duration) (net.Listener, error) {
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		ln, err := net.Listen("tcp", addr)
+		if err == nil {
+			return ln, nil
+		}
+		lastErr = err
+		if attempt < retries {
+			log.Printf("bind attempt %d/%d failed: %v (retrying in %s)", attempt+1, retries+1, err, delay)
+			time.Sleep(delay)
+		}
+	}
+	return nil, lastErr
+}
+
+// handleConn serves requests on conn one after another until the client
+// closes it or sends something undecodable. Responses go out in request order.
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	if err := s.handshake(conn); err != nil {
+		log.Printf("[%s] TLS handshake failed, closing: %v", remote, err)
+		return
+	}
+	s.armReadDeadline(conn)
+	in := &firstByteReader{r: conn}
+	body, err := s.requestReader(in)
+	if err != nil {
+		if s.shuttingDown.Load() {
+			return
+		}
+		log.Printf("[%s] gzip error: %v", remote, err)
+		sendError(s.newCodec(conn, conn), "", ErrBadRequest, "invalid gzip stream")
+		return
+	}
+	codec := s.newCodec(body, newRateLimitedWriter(conn, s.cfg.WriteRate))
+	ip := remoteIP(conn)
+	budget := s.newCallBudget()
+	// a panicking handler costs this connection, not the whole server
+	var current *Request
+	defer recoverPanic(remote, codec, &current)
+	for served := 0; ; served++ {
+		if s.cfg.MaxRequestsPerConn > 0 && served >= s.cfg.MaxRequestsPerConn {
+			log.Printf("[%s] closing after %d requests (-max-requests-per-conn)", remote, served)
+			return
+		}
+		// the last allowed request's response tells the client to reconnect
+		last := s.cfg.MaxRequestsPerConn > 0 && served+1 == s.cfg.MaxRequestsPerConn
+		if served > 0 {
+			// the first request's deadline and first byte also covered the gzip sniff
+			s.armReadDeadline(conn)
+			in.reset()
+		}
+		readStart := time.Now()
+		msg, err := codec.readMessage()
+		goodbye := false
+		if isTimeout(err) && s.cfg.GracefulCloseOnIdle && in.at.IsZero() && !s.shuttingDown.Load() {
+			// nothing of a next request arrived: say goodbye, but still answer
+			// one the client sent as the goodbye went out
+			log.Printf("[%s] idle after %d requests, saying goodbye", remote, served)
+			if err := codec.writeMessage(&Response{Status: "GOODBYE", Close: true}); err != nil {
+				s.debugf("[%s] goodbye not sent: %v", remote, err)
+				return
+			}
+			goodbye, last = true, true
+			conn.SetReadDeadline(time.Now().Add(goodbyeGrace))
+			msg, err = codec.readMessage()
+		}
+		// stamped once the request is in, so time idling between requests
+		// on a persistent connection doesn't count against its deadline
+		at := arrival{firstByte: in.since(readStart), read: time.Now(), seq: served + 1, budget: budget}
+		if err != nil {
+			if err == io.EOF {
+				s.debugf("[%s] connection closed by client after %d requests", remote, served)
+				return
+			}
+			if goodbye {
+				s.debugf("[%s] closing after goodbye: %v", remote, err)
+				return
+			}
+			if errors.Is(err, errFrameTooLarge) {
+				// the oversized payload was skipped, so the stream is still aligned
+				log.Printf("[%s] rejected frame: %v", remote, err)
+				sendError(codec, "", ErrBadRequest, err.Error())
+				continue
+			}
+			if s.shuttingDown.Load() {
+				s.debugf("[%s] closing for shutdown after %d requests", remote, served)
+				return
+			}
+			if isTimeout(err) {
+				log.Printf("[%s] read timeout after %d requests, closing", remote, served)
+				sendError(codec, "", ErrReadTimeout, "read timeout")
+				return
+			}
+			log.Printf("[%s] decode error after %d requests, closing: %v", remote, served, err)
+			if errors.Is(err, errRequestTooLarge) {
+				sendError(codec, "", ErrRequestTooLarge, err.Error())
+				return
+			}
+			if errors.Is(err, errDecompressionLimit) {
+				sendError(codec, "", ErrBadRequest, err.Error())
+				return
+			}
+			sendError(codec, "", ErrBadRequest, "invalid json")
+			return
+		}
+		if s.cfg.Strict && pendingInput(codec) {
+			log.Printf("[%s] trailing data after request, closing", remote)
+			sendError(codec, "", ErrMalformedStream, "trailing data after request")
+			return
+		}
+		if s.cfg.Framing == "length" && hasTrailingData(msg) {
+			// the frame boundary is intact, so only this request is bad
+			log.Printf("[%s] trailing data in frame", remote)
+			sendError(codec, "", ErrMalformedStream, "trailing data after request")
+			continue
+		}
+		if s.rateLimiter != nil {
+			if ok, wait := s.rateLimiter.allow(ip); !ok {
+				log.Printf("[%s] rate limited after %d requests, closing", remote, served)
+				sendRateLimited(codec, wait)
+				return
+			}
+		}
+		if isBatch(msg) {
+			current = nil
+			if !s.serveBatch(codec, remote, msg, at, last) || s.cfg.Strict || goodbye {
+				return
+			}
+			continue
+		}
+		var req Request
+		if err := DecodeJSON(msg, &req); err != nil {
+			// the message boundary was found, so only this request is bad
+			log.Printf("[%s] invalid request: %v", remote, err)
+			sendError(codec, "", ErrBadRequest, "invalid json")
+			continue
+		}
+		current = &req
+		if !s.serveRequest(conn, codec, remote, &req, at, last) || s.cfg.Strict || goodbye {
+			return
+		}
+	}
+}
+
+// goodbyeGrace is how long after a -graceful-close-on-idle goodbye the server
+// waits for a request the client already had in flight
+const goodbyeGrace = time.Second
+
+// hasTrailingData reports whether msg holds more than one JSON value
+func hasTrailingData(msg []byte) bool {
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	var v json.RawMessage
+	if dec.Decode(&v) != nil {
+		return false
+	}
+	_, err := dec.Token()
+	return err != io.EOF
+}
+
+// pendingInput reports whether the client has already sent more than the
+// message just read. Only json framing buffers ahead, so other codecs never
+// report pending input.
+func pendingInput(c wireCodec) bool {
+	if j, ok := c.(*jsonrpcCodec); ok {
+		c = j.wireCodec
+	}
+	jc, ok := c.(*jsonCodec)
+	return ok && jc.in.pending()
+}
+
+// arrival is when a request came in: firstByte starts its timings and audit
+// duration, read (the whole request received) starts its deadline_ms. seq
+// numbers the messages on a connection from 1; the requests of a batch share
+// one. budget is the connection's -method-call-budget, nil when unlimited.
+type arrival struct {
+	firstByte time.Time
+	read      time.Time
+	seq       int
+	budget    *callBudget
+}
+
+// arrivedNow is the arrival of a request that was read in one go, like a datagram
+func arrivedNow() arrival {
+	now := time.Now()
+	return arrival{firstByte: now, read: now, seq: 1}
+}
+
+// firstByteReader notes when data first came in since the last reset, so a
+// request's decode time starts at its first byte rather than when the
+// server began waiting for it
+type firstByteReader struct {
+	r  io.Reader
+	at time.Time
+}
+
+func (f *firstByteReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if n > 0 && f.at.IsZero() {
+		f.at = time.Now()
+	}
+	return n, err
+}
+
+func (f *firstByteReader) reset() { f.at = time.Time{} }
+
+// since returns when the first byte came in, or start if nothing was read
+// because the request was already buffered
+func (f *firstByteReader) since(start time.Time) time.Time {
+	if f.at.IsZero() {
+		return start
+	}
+	return f.at
+}
+
+// handshake completes the TLS handshake on conn within -handshake-timeout,
+// so a client that stalls part way through it is dropped rather than holding
+// a connection slot. Plaintext connections have no handshake.
+func (s *Server) handshake(conn net.Conn) error {
+	tc, ok := conn.(*tls.Conn)
+	if !ok || s.cfg.HandshakeTimeout <= 0 {
+		return nil
+	}
+	tc.SetDeadline(time.Now().Add(s.cfg.HandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	return tc.SetDeadline(time.Time{})
+}
+
+// how often -tls-reload checks the certificate files for changes
+const certReloadInterval = 5 * time.Second
+
+// certReloader hands out the -tls-cert/-tls-key pair for each handshake,
+// reloading it when the files change or on ReloadTLS. A pair that fails to
+// load, e.g. while the files are half written, leaves the previous one in use.
+type certReloader struct {
+	certFile, keyFile string
+	mu                sync.RWMutex
+	cert              *tls.Certificate
+	modTime           time.Time // the later of the two files' modification times
+}
+
+func (r *certReloader) reload() error {
+	mod, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = mod
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// get is the tls.Config GetCertificate callback
+func (r *certReloader) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// watch reloads the pair whenever either file's modification time changes
+func (r *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		mod, err := r.filesModTime()
+		if err != nil {
+			log.Printf("tls reload: %v", err)
+			continue
+		}
+		r.mu.RLock()
+		changed := !mod.Equal(r.modTime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.reload(); err != nil {
+			log.Printf("TLS reload failed, keeping the current certificate: %v", err)
+			continue
+		}
+		log.Printf("TLS certificate reloaded from %s", r.certFile)
+	}
+}
+
+// ReloadTLS re-reads the certificate and key now, as the server command does
+// on SIGHUP. On error the current pair stays in use. It needs -tls-reload.
+func (s *Server) ReloadTLS() error {
+	if s.certs == nil {
+		return errors.New("TLS reload needs -tls-reload")
+	}
+	return s.certs.reload()
+}
+
+// armReadDeadline gives the client -read-timeout to send its next request.
+// Once shutdown has begun it keeps drain's immediate deadline instead.
+func (s *Server) armReadDeadline(conn net.Conn) {
+	if s.cfg.ReadTimeout <= 0 {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(s.cfg.ReadTimeout))
+	if s.shuttingDown.Load() {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// recoverPanic, deferred by connection handlers, logs a panic raised while
+// serving *current and answers it with an internal error
+func recoverPanic(remote string, codec wireCodec, current **Request) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	id := ""
+	if *current != nil {
+		id = (*current).RequestID
+	}
+	stack := debug.Stack()
+	if hp, ok := p.(*handlerPanic); ok {
+		p, stack = hp.value, hp.stack
+	}
+	log.Printf("[%s] panic serving request id=%s: %v\n%s", remote, id, p, stack)
+	sendError(codec, id, ErrInternal, "internal server error")
+}
+
+// isBatch reports whether a message is a JSON array of requests
+func isBatch(msg []byte) bool {
+	trimmed := bytes.TrimLeft(msg, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// serveRequest processes one decoded request and writes its response,
+// flagged with the close hint when closing is set. It returns false when the
+// connection must not be used any further.
+func (s *Server) serveRequest(conn net.Conn, codec wireCodec, remote string, req *Request, at arrival, closing bool) bool {
+	resp := s.buildResponse(remote, req, at)
+
+	// simulate a situation where server might crash after processing but before sending:
+	if strings.ToLower(req.Method) == "crash" && resp.Status == "OK" {
+		log.Printf("Crash requested by client. Exiting server process.")
+		// Send response before crash to show partial scenarios, optionally:
+		_ = codec.writeMessage(resp) // ignore error
+		// exit immediately (simulate crash)
+		s.exit(1)
+		return false
+	}
+
+	// deterministic partial-crash: the full response is written and flushed
+	// before the process exits
+	if strings.ToLower(req.Method) == "sleep_then_crash" && resp.Status == "OK" {
+		if err := codec.writeMessage(resp); err != nil {
+			log.Printf("[%s] encode error before crash: %v", remote, err)
+		}
+		// both *net.TCPConn and *tls.Conn support a half close
+		if hc, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = hc.CloseWrite()
+		}
+		log.Printf("sleep_then_crash: response sent for id=%s. Exiting server process.", req.RequestID)
+		s.exit(1)
+		return false
+	}
+
+	if req.Oneway {
+		log.Printf("[%s] Processed oneway request id=%s status=%s (no response sent)", remote, req.RequestID, resp.Status)
+		return true
+	}
+
+	if stream, ok := resp.Result.(streamResult); ok {
+		s.serveStream(codec, remote, req, at, stream)
+		return false
+	}
+
+	if closing {
+		// copy so a response held by the idempotency cache keeps no hint
+		r := *resp
+		r.Close = true
+		resp = &r
+	}
+	err := codec.writeMessage(resp)
+	if errors.Is(err, errFrameTooLarge) {
+		log.Printf("[%s] response id=%s too large for a frame: %v", remote, req.RequestID, err)
+		err = codec.writeMessage(&Response{RequestID: req.RequestID, Status: "ERROR", Error: "response too large", Code: ErrResourceLimit})
+	}
+	if err != nil {
+		if isClientDisconnect(err) {
+			// expected when clients time out and hang up; keep it out of error logs
+			s.stats.disconnected()
+			s.debugf("[%s] client disconnected before response id=%s: %v", remote, req.RequestID, err)
+			return false
+		}
+		log.Printf("[%s] encode error: %v", remote, err)
+		return false
+	}
+	log.Printf("[%s] Responded request id=%s status=%s", remote, req.RequestID, resp.Status)
+	return true
+}
+
+// streamResult is a handler result sent as a sequence of response frames,
+// one per value passed to emit. The connection is closed after the last
+// frame, which is how the client knows the stream has ended.
+type streamResult func(ctx context.Context, emit func(v interface{}) error) error
+
+// serveStream runs stream, writing each value as its own OK response for req. If
+// the stream fails part way a final ERROR frame says why.
+func (s *Server) serveStream(codec wireCodec, remote string, req *Request, at arrival, stream streamResult) {
+	ctx, cancel := requestContext(req.Params, at.read)
+	defer cancel()
+	frames := 0
+	emit := func(v interface{}) error {
+		frames++
+		return codec.writeMessage(&Response{RequestID: req.RequestID, Result: s.transformResult(v), Status: "OK", Attempt: req.Attempt})
+	}
+	err := stream(ctx, emit)
+	switch {
+	case err == nil:
+		log.Printf("[%s] Streamed %d frames for request id=%s", remote, frames, req.RequestID)
+	case isClientDisconnect(err):
+		s.stats.disconnected()
+		s.debugf("[%s] client disconnected during stream id=%s: %v", remote, req.RequestID, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Printf("[%s] stream id=%s abandoned after %d frames: %v", remote, req.RequestID, frames, err)
+		sendError(codec, req.RequestID, ErrDeadlineExceeded, "deadline exceeded")
+	default:
+		log.Printf("[%s] stream id=%s failed after %d frames: %v", remote, req.RequestID, frames, err)
+		sendError(codec, req.RequestID, ErrInternal, "stream failed")
+	}
+}
+
+// serveBatch answers a JSON array of requests with an array of responses in
+// the same order. Elements are processed one by one and independently, so a
+// bad element only produces an error entry. Oneway elements get no entry.
+// With closing set, the last entry carries the close hint.
+func (s *Server) serveBatch(codec wireCodec, remote string, msg []byte, at arrival, closing bool) bool {
+	var elems []json.RawMessage
+	if err := json.Unmarshal(msg, &elems); err != nil {
+		log.Printf("[%s] invalid batch: %v", remote, err)
+		sendError(codec, "", ErrBadRequest, "invalid json")
+		return true
+	}
+	if len(elems) == 0 {
+		sendError(codec, "", ErrBadRequest, "empty batch")
+		return true
+	}
+	log.Printf("[%s] Received batch of %d requests", remote, len(elems))
+	resps := make([]*Response, 0, len(elems))
+	for _, elem := range elems {
+		var req Request
+		if err := DecodeJSON(elem, &req); err != nil {
+			resps = append(resps, &Response{Status: "ERROR", Error: "invalid json", Code: ErrBadRequest})
+			continue
+		}
+		switch strings.ToLower(req.Method) {
+		case "crash", "sleep_then_crash", "countdown":
+			// these take the whole process down or stream until the
+			// connection closes; only allowed on their own
+			resps = append(resps, &Response{RequestID: req.RequestID, Status: "ERROR", Error: fmt.Sprintf("method '%s' not allowed in a batch", req.Method), Code: ErrBadRequest})
+			continue
+		}
+		resp := s.buildResponse(remote, &req, at)
+		if req.Oneway {
+			continue
+		}
+		resps = append(resps, resp)
+	}
+	if len(resps) == 0 {
+		return true
+	}
+	if closing {
+		r := *resps[len(resps)-1]
+		r.Close = true
+		resps[len(resps)-1] = &r
+	}
+
+	err := codec.writeMessage(resps)
+	if errors.Is(err, errFrameTooLarge) {
+		log.Printf("[%s] batch response too large for a frame: %v", remote, err)
+		err = codec.writeMessage(&Response{Status: "ERROR", Error: "response too large", Code: ErrResourceLimit})
+	}
+	if err != nil {
+		if isClientDisconnect(err) {
+			s.stats.disconnected()
+			s.debugf("[%s] client disconnected before batch response: %v", remote, err)
+			return false
+		}
+		log.Printf("[%s] encode error: %v", remote, err)
+		return false
+	}
+	log.Printf("[%s] Responded batch of %d", remote, len(resps))
+	return true
+}
+
+// buildResponse runs one request through dispatch and the result pipeline
+// (paging, transforms, checksum, timings) without writing anything
+func (s *Server) buildResponse(remote string, req *Request, at arrival) *Response {
+	s.applyDefaultParams(req)
+	attempt := s.retries.observe(req.RequestID)
+	if attempt > 1 {
+		s.stats.retried()
+	}
+	log.Printf("[%s] Received request id=%s attempt=%d client_attempt=%d method=%s params=%v", remote, req.RequestID, attempt, req.Attempt, req.Method, req.Params)
+	var resp *Response
+	if !s.authorized(req) {
+		// checked before the idempotency cache so a replay can't leak a result
+		log.Printf("[%s] request id=%s rejected: missing or wrong auth token", remote, req.RequestID)
+		resp = &Response{RequestID: req.RequestID, Status: "ERROR", Error: "unauthorized", Code: ErrUnauthorized, Attempt: req.Attempt}
+	} else if !at.budget.spend(req.Method) {
+		log.Printf("[%s] request id=%s rejected: connection budget exhausted", remote, req.RequestID)
+		resp = &Response{RequestID: req.RequestID, Status: "ERROR", Error: "connection budget exhausted", Code: ErrResourceLimit, Attempt: req.Attempt}
+	} else if s.idempotency != nil && req.RequestID != "" {
+		var cached bool
+		resp, cached = s.idempotency.do(req, func() *Response { return s.computeResponse(remote, req, at) })
+		if cached {
+			// replays are private copies, so this doesn't touch the cached entry
+			resp.Attempt = req.Attempt
+			log.Printf("[%s] request id=%s answered from idempotency cache", remote, req.RequestID)
+		}
+	} else {
+		resp = s.computeResponse(remote, req, at)
+	}
+	if s.audit != nil {
+		s.audit.record(remote, req, resp, time.Since(at.firstByte))
+	}
+	return resp
+}
+
+// authorized reports whether req carries the -auth-token, comparing in
+// constant time
+func (s *Server) authorized(req *Request) bool {
+	if s.cfg.AuthToken == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(req.AuthToken), []byte(s.cfg.AuthToken)) == 1
+}
+
+// computeResponse runs the method and the result pipeline for buildResponse
+func (s *Server) computeResponse(remote string, req *Request, at arrival) *Response {
+	ctx, cancel := requestContext(req.Params, at.read)
+	defer cancel()
+	ctx = withRequestMeta(ctx, requestMeta{requestID: req.RequestID, remote: remote, receivedAt: at.read, connSeq: at.seq})
+	start := time.Now()
+	resp, queued := s.dispatch(ctx, req)
+	elapsed := time.Since(start)
+	if req.TraceID != "" {
+		logSpan(req, resp, start)
+		resp.TraceID = req.TraceID
+	}
+	resp.Attempt = req.Attempt
+	s.slowest.record(req, elapsed)
+	if !s.cfg.NoTiming {
+		resp.DurationMs = durationMs(elapsed - queued)
+	}
+	if s.cfg.ResultPaging && resp.Status == "OK" {
+		if err := pageResult(resp, req.Params); err != nil {
+			resp.Result = nil
+			resp.Status = "ERROR"
+			resp.Error = err.Error()
+			resp.Code = ErrBadParams
+		}
+	}
+
+	encodeStart := time.Now()
+	// streams are transformed frame by frame as serveStream sends them
+	if _, ok := resp.Result.(streamResult); !ok {
+		resp.Result = s.transformResult(resp.Result)
+	}
+	if (s.cfg.ResponseChecksum != "" || s.cfg.TimingDetail) && resp.Result != nil {
+		if b, err := json.Marshal(resp.Result); err == nil {
+			if s.cfg.ResponseChecksum != "" {
+				resp.Checksum = resultChecksum(s.cfg.ResponseChecksum, b)
+			}
+			// reuse the serialized bytes so the final encode is just a copy
+			resp.Result = json.RawMessage(b)
+		}
+	}
+	if s.cfg.TimingDetail {
+		resp.Timings = &Timings{
+			DecodeMs:  durationMs(start.Sub(at.firstByte)),
+			QueueMs:   durationMs(queued),
+			HandlerMs: durationMs(elapsed - queued),
+			EncodeMs:  durationMs(time.Since(encodeStart)),
+		}
+		resp.Timings.TotalMs = durationMs(time.Since(at.firstByte))
+	}
+	return resp
+}
+
+func (s *Server) newCodec(r io.Reader, w io.Writer) wireCodec {
+	if s.cfg.Framing == "length" {
+		return s.withProtocol(&lengthCodec{r: r, w: w, max: s.cfg.MaxFrameSize})
+	}
+	lim := &messageLimiter{r: r, max: s.cfg.MaxRequestBytes}
+	return s.withProtocol(&jsonCodec{in: newMessageReader(lim, s.cfg.MaxRequestBytes, errRequestTooLarge), w: w, enc: json.NewEncoder(w), lim: lim})
+}
+
+// withProtocol wraps c to speak the -protocol message shape
+func (s *Server) withProtocol(c wireCodec) wireCodec {
+	if s.cfg.Protocol == "jsonrpc2" {
+		return &jsonrpcCodec{wireCodec: c, clock: s.clock}
+	}
+	return c
+}
+
+// isClientDisconnect reports whether a write failed because the peer closed
+// the connection. Go ignores SIGPIPE on sockets, so these surface as EPIPE or
+// ECONNRESET errors instead of killing the process.
+func isClientDisconnect(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed)
+}
+
+// debugf logs only when -debug is set
+func (s *Server) debugf(format string, args ...interface{}) {
+	if s.cfg.Debug {
+		log.Printf("DEBUG "+format, args...)
+	}
+}
+
+// longest request_id accepted; ids are for correlation, not payload
+const maxRequestIDLen = 128
+
+// validateRequest applies server-wide request policies before dispatch
+func (s *Server) validateRequest(req *Request) error {
+	if strings.TrimSpace(req.RequestID) == "" {
+		return errors.New("missing request_id")
+	}
+	if len(req.RequestID) > maxRequestIDLen {
+		return fmt.Errorf("request_id too long: %d bytes exceeds %d", len(req.RequestID), maxRequestIDLen)
+	}
+	if s.cfg.RequireTimestamp && strings.TrimSpace(req.Timestamp) == "" {
+		return errors.New("timestamp required")
+	}
+	if s.cfg.MaxParamsKeys > 0 && len(req.Params) > s.cfg.MaxParamsKeys {
+		return fmt.Errorf("too many params: %d keys exceeds limit of %d", len(req.Params), s.cfg.MaxParamsKeys)
+	}
+	if err := s.checkClockSkew(req); err != nil {
+		if s.cfg.MaxClockSkewAction != "warn" {
+			return err
+		}
+		log.Printf("warning: request id=%s %v (processing anyway)", req.RequestID, err)
+	}
+	if v, ok := req.Params["deadline_ms"]; ok {
+		if ms, err := asInt(v); err != nil || ms <= 0 {
+			return errors.New("invalid param 'deadline_ms': want a positive integer")
+		}
+	}
+	if s.cfg.MaxStringLen > 0 {
+		for k, v := range req.Params {
+			if longestString(v) > s.cfg.MaxStringLen {
+				return fmt.Errorf("string too long: param '%s' exceeds %d bytes", k, s.cfg.MaxStringLen)
+			}
+		}
+	}
+	return nil
+}
+
+// checkClockSkew compares the request timestamp with the server clock.
+// Requests without a timestamp are left to the -require-timestamp policy.
+func (s *Server) checkClockSkew(req *Request) error {
+	if s.cfg.MaxClockSkew <= 0 || strings.TrimSpace(req.Timestamp) == "" {
+		return nil
+	}
+	ts, err := time.Parse(time.RFC3339, req.Timestamp)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %v", err)
+	}
+	skew := s.clock.Now().Sub(ts)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > s.cfg.MaxClockSkew {
+		return fmt.Errorf("clock skew %s exceeds %s", skew.Round(time.Millisecond), s.cfg.MaxClockSkew)
+	}
+	return nil
+}
+
+// longestString returns the length of the longest string found in v,
+// descending into nested objects and arrays
+func longestString(v interface{}) int {
+	longest := 0
+	switch t := v.(type) {
+	case string:
+		longest = len(t)
+	case map[string]interface{}:
+		for k, e := range t {
+			if len(k) > longest {
+				longest = len(k)
+			}
+			if n := longestString(e); n > longest {
+				longest = n
+			}
+		}
+	case []interface{}:
+		for _, e := range t {
+			if n := longestString(e); n > longest {
+				longest = n
+			}
+		}
+	}
+	return longest
+}
+
+// applyDefaultParams fills in configured defaults the client didn't send
+func (s *Server) applyDefaultParams(req *Request) {
+	defaults := s.cfg.DefaultParams[strings.ToLower(req.Method)]
+	if len(defaults) == 0 {
+		return
+	}
+	if req.Params == nil {
+		req.Params = map[string]interface{}{}
+	}
+	for k, v := range defaults {
+		if _, ok := req.Params[k]; !ok {
+			req.Params[k] = v
+		}
+	}
+}
+
+// SetQuiesced switches quiesce mode; in-flight requests always finish
+func (s *Server) SetQuiesced(on bool) {
+	if s.quiesced.Swap(on) == on {
+		return
+	}
+	if on {
+		log.Printf("Server quiesced: rejecting new requests, %d in flight will finish", s.inFlight.Load())
+	} else {
+		log.Printf("Server resumed")
+	}
+}
+
+// dispatch runs the request, sending expensive methods to the slow pool so
+// they can't tie up capacity needed by cheap ones. It also returns how long
+// the request waited for a pool worker.
+func (s *Server) dispatch(ctx context.Context, req *Request) (*Response, time.Duration) {
+	method := strings.ToLower(req.Method)
+	if method == "ping" {
+		// liveness probes skip readiness, quiesce and capacity checks
+		return s.processRequest(ctx, req), 0
+	}
+	if time.Now().Before(s.readyAt) {
+		return &Response{RequestID: req.RequestID, Status: "ERROR", Error: "server warming up", Code: ErrNotReady, RetryAfterMs: retryAfterMs(time.Until(s.readyAt))}, 0
+	}
+	if s.quiesced.Load() && method != "quiesce" && method != "unquiesce" {
+		return &Response{RequestID: req.RequestID, Status: "ERROR", Error: "server quiesced", Code: ErrUnavailable}, 0
+	}
+	s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	if s.activeSlots != nil {
+		select {
+		case s.activeSlots <- struct{}{}:
+			defer func() { <-s.activeSlots }()
+		default:
+			log.Printf("request id=%s method=%s rejected: %d requests already active", req.RequestID, req.Method, cap(s.activeSlots))
+			return &Response{RequestID: req.RequestID, Status: "ERROR", Error: "server at capacity", Code: ErrUnavailable}, 0
+		}
+	}
+	if s.slowPool != nil && s.slowMethods[method] {
+		return s.slowPool.submit(ctx, req)
+	}
+	return s.runWithMemoryLimit(ctx, req, s.cfg.MaxRequestMemory), 0
+}
+
+// requestContext derives the request's context from its optional deadline_ms
+// param, measured from when the server read the request. Invalid values are
+// left for validateRequest to reject.
+func requestContext(params map[string]interface{}, accepted time.Time) (context.Context, context.CancelFunc) {
+	if v, ok := params["deadline_ms"]; ok {
+		if ms, err := asInt(v); err == nil && ms > 0 {
+			return context.WithDeadline(context.Background(), accepted.Add(time.Duration(ms)*time.Millisecond))
+		}
+	}
+	return context.WithCancel(context.Background())
+}
+
+// requestMeta is what the server observed about a request on arrival.
+// connSeq is the request's position on its connection, for handlers that
+// keep per-connection state.
+type requestMeta struct {
+	requestID  string
+	remote     string
+	receivedAt time.Time
+	connSeq    int
+}
+
+type requestMetaKey struct{}
+
+func withRequestMeta(ctx context.Context, m requestMeta) context.Context {
+	return context.WithValue(ctx, requestMetaKey{}, m)
+}
+
+func requestMetaFrom(ctx context.Context) requestMeta {
+	m, _ := ctx.Value(requestMetaKey{}).(requestMeta)
+	return m
+}
+
+// sendError sends a simple error response with optional requestID
+func sendError(codec wireCodec, reqID string, code string, msg string) {
+	resp := Response{
+		RequestID: reqID,
+		Status:    "ERROR",
+		Error:     msg,
+		Code:      code,
+	}
+	_ = codec.writeMessage(resp)
+}
+
+// sendRateLimited tells a client over its -rate when it can send again
+func sendRateLimited(codec wireCodec, wait time.Duration) {
+	_ = codec.writeMessage(Response{Status: "ERROR", Error: "rate limited", Code: ErrRateLimited, RetryAfterMs: retryAfterMs(wait)})
+}
+
+// retryAfterMs rounds d up to the whole milliseconds of a retry_after_ms hint
+func retryAfterMs(d time.Duration) int64 {
+	ms := int64((d + time.Millisecond - 1) / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return ms
+}
@@ -0,0 +1,1246 @@
+package rpclab
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// the server logs every request; keep test output readable
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// startServer serves a DefaultConfig server, adjusted by configure, on a
+// loopback port and returns it with its address; it is shut down when the
+// test ends
+func startServer(t testing.TB, configure func(*Config)) (*Server, string) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.ShutdownTimeout = time.Second
+	if configure != nil {
+		configure(&cfg)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return s, serve(t, s)
+}
+
+// serve runs s on a loopback port until the test ends and returns the address
+func serve(t testing.TB, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(ln, s.tlsConfig)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+	t.Cleanup(func() {
+		s.Shutdown()
+		if err := <-done; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+	return ln.Addr().String()
+}
+
+// writeTestCert writes a fresh self-signed certificate for 127.0.0.1 and its
+// key as PEM files in dir and returns the certificate
+func writeTestCert(t *testing.T, dir string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "rpclab test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// logBuffer collects log output; the server logs from its own goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends log output to a buffer until the test ends
+func captureLog(t *testing.T) *logBuffer {
+	b := &logBuffer{}
+	log.SetOutput(b)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	return b
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// call sends one request on a fresh client and fails the test on a
+// transport error
+func call(t *testing.T, addr, method string, params map[string]interface{}) *Response {
+	t.Helper()
+	c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+	defer c.Close()
+	resp, err := c.Call(method, params)
+	if resp == nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	return resp
+}
+
+// rawCall sends req as is on a new connection and returns the raw response
+func rawCall(t *testing.T, addr, req string) []byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	msg, _, err := newMessageReader(conn, 0, errResponseTooLarge).next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestServeMethods(t *testing.T) {
+	_, addr := startServer(t, nil)
+	tests := []struct {
+		method string
+		params map[string]interface{}
+		result string
+		code   string
+	}{
+		{"add", map[string]interface{}{"a": 2, "b": 3}, "5", ""},
+		{"subtract", map[string]interface{}{"a": 2, "b": 3}, "-1", ""},
+		{"multiply", map[string]interface{}{"a": 4, "b": 3}, "12", ""},
+		{"reverse_string", map[string]interface{}{"s": "abc"}, "cba", ""},
+		{"ping", nil, "pong", ""},
+		{"add", map[string]interface{}{"a": 1}, "", ErrBadParams},
+		{"no_such_method", nil, "", ErrUnknownMethod},
+		{"crash", nil, "", ErrMethodDisabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			resp := call(t, addr, tt.method, tt.params)
+			if resp.Code != tt.code {
+				t.Fatalf("code = %q (%s), want %q", resp.Code, resp.Error, tt.code)
+			}
+			if tt.code != "" {
+				if resp.Status != "ERROR" {
+					t.Errorf("status = %q, want ERROR", resp.Status)
+				}
+				return
+			}
+			if got := fmt.Sprint(resp.Result); got != tt.result {
+				t.Errorf("result = %s, want %s", got, tt.result)
+			}
+		})
+	}
+}
+
+// BenchmarkConnChurn opens a connection per ping, from many dialers at once,
+// against goroutine-per-connection and -workers pools
+func BenchmarkConnChurn(b *testing.B) {
+	modes := []struct {
+		name    string
+		workers int
+	}{
+		{"goroutine-per-conn", 0},
+		{"workers-8", 8},
+		{"workers-64", 64},
+	}
+	for _, m := range modes {
+		b.Run(m.name, func(b *testing.B) {
+			_, addr := startServer(b, func(cfg *Config) {
+				cfg.Workers = m.workers
+				cfg.WorkerQueue = 256
+			})
+			req := []byte(`{"request_id":"b","method":"ping"}` + "\n")
+			b.SetParallelism(8) // 8 dialers per CPU
+			b.ResetTimer()
+			start := time.Now()
+			b.RunParallel(func(pb *testing.PB) {
+				buf := make([]byte, 512)
+				for pb.Next() {
+					conn, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if _, err := conn.Write(req); err != nil {
+						b.Error(err)
+					} else if n, err := conn.Read(buf); err != nil || !bytes.Contains(buf[:n], []byte(`"OK"`)) {
+						b.Errorf("ping: %q, %v", buf[:n], err)
+					}
+					conn.Close()
+				}
+			})
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "conns/s")
+		})
+	}
+}
+
+func TestShutdownStopsServe(t *testing.T) {
+	s, err := NewServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+	if resp := call(t, ln.Addr().String(), "ping", nil); resp.Status != "OK" {
+		t.Fatalf("ping: %+v", resp)
+	}
+	if !s.Shutdown() {
+		t.Error("Shutdown did not drain")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after Shutdown")
+	}
+}
+
+func TestDeadlineIgnoresIdleTime(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second, PoolSize: 1})
+	defer c.Close()
+	if _, err := c.Call("ping", nil); err != nil {
+		t.Fatal(err)
+	}
+	// idle on the pooled connection for longer than the deadline leaves
+	// after the 1s sleep; the deadline runs from the request's arrival
+	time.Sleep(400 * time.Millisecond)
+	if _, err := c.Call("slow", map[string]interface{}{"sleep": 1, "deadline_ms": 1200}); err != nil {
+		t.Errorf("slow after idling: %v", err)
+	}
+}
+
+func TestTimingDetailStartsAtFirstByte(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) { cfg.TimingDetail = true })
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	codec := &jsonCodec{in: newMessageReader(conn, 0, errRequestTooLarge)}
+
+	// idle before the request starts, then stall half way through it
+	time.Sleep(200 * time.Millisecond)
+	req := []byte(`{"request_id":"t1","method":"add","params":{"a":1,"b":2}}`)
+	conn.Write(req[:20])
+	time.Sleep(100 * time.Millisecond)
+	conn.Write(req[20:])
+
+	msg, err := codec.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp Response
+	if err := DecodeJSON(msg, &resp); err != nil {
+		t.Fatal(err)
+	}
+	tm := resp.Timings
+	if tm == nil {
+		t.Fatalf("no timings in %s", msg)
+	}
+	if tm.DecodeMs < 90 || tm.DecodeMs > 190 {
+		t.Errorf("decode_ms = %.1f, want the ~100ms stall but not the 200ms idle", tm.DecodeMs)
+	}
+	sum := tm.DecodeMs + tm.QueueMs + tm.HandlerMs + tm.EncodeMs
+	if tm.TotalMs < sum || tm.TotalMs > sum+5 {
+		t.Errorf("total_ms = %.3f, stages sum to %.3f", tm.TotalMs, sum)
+	}
+}
+
+func TestParseClockSource(t *testing.T) {
+	pinned := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		src     string
+		want    time.Time // zero for the system clock
+		wantErr bool
+	}{
+		{"system", time.Time{}, false},
+		{"", time.Time{}, false},
+		{"2024-01-02T03:04:05Z", pinned, false},
+		{"2024-01-02T04:04:05+01:00", pinned, false},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			clock, err := ParseClockSource(tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.want.IsZero() {
+				if _, ok := clock.(systemClock); !ok {
+					t.Errorf("clock = %T, want systemClock", clock)
+				}
+			} else if !clock.Now().Equal(tt.want) {
+				t.Errorf("Now() = %s, want %s", clock.Now(), tt.want)
+			}
+		})
+	}
+}
+
+func TestPinnedClock(t *testing.T) {
+	pinned := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	_, addr := startServer(t, func(cfg *Config) {
+		cfg.Clock = fixedClock{t: pinned}
+		cfg.MaxClockSkew = time.Minute
+	})
+	// Call stamps requests with real time, so send them with Do
+	c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+	defer c.Close()
+	resp, err := c.Do(&Request{RequestID: "t", Method: "get_time"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(resp.Result); got != "2024-01-02T03:04:05Z" {
+		t.Errorf("get_time = %s, want the pinned time", got)
+	}
+
+	// the skew check measures against the pinned clock, not real time
+	tests := []struct {
+		name      string
+		timestamp string
+		code      string
+	}{
+		{"matching", "2024-01-02T03:04:05Z", ""},
+		{"within skew", "2024-01-02T03:04:50Z", ""},
+		{"behind", "2024-01-02T03:02:00Z", ErrBadRequest},
+		{"ahead", "2024-01-02T03:06:00Z", ErrBadRequest},
+		{"real time", time.Now().UTC().Format(time.RFC3339), ErrBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _ := c.Do(&Request{RequestID: tt.name, Method: "ping", Timestamp: tt.timestamp})
+			if resp == nil {
+				t.Fatal("no response")
+			}
+			if resp.Code != tt.code {
+				t.Errorf("code = %q (%s), want %q", resp.Code, resp.Error, tt.code)
+			}
+		})
+	}
+}
+
+func TestOversizedFrameKeepsConnection(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) {
+		cfg.Framing = "length"
+		cfg.MaxFrameSize = 128
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	codec := &lengthCodec{r: conn, w: conn, max: 1 << 20}
+
+	long := strings.Repeat("x", 200)
+	tests := []struct {
+		name  string
+		frame string
+		code  string
+	}{
+		{"valid before", `{"request_id":"1","method":"add","params":{"a":1,"b":2}}`, ""},
+		{"oversized request", `{"request_id":"2","method":"reverse_string","params":{"s":"` + long + `"}}`, ErrBadRequest},
+		{"valid after", `{"request_id":"3","method":"ping"}`, ""},
+		// the reply would not fit in a frame either
+		{"oversized response", `{"request_id":"4","method":"list_methods"}`, ErrResourceLimit},
+		{"still valid", `{"request_id":"5","method":"ping"}`, ""},
+	}
+	for _, tt := range tests {
+		if err := writeFrame(conn, []byte(tt.frame)); err != nil {
+			t.Fatalf("%s: write: %v", tt.name, err)
+		}
+		msg, err := codec.readMessage()
+		if err != nil {
+			t.Fatalf("%s: connection dropped: %v", tt.name, err)
+		}
+		var resp Response
+		if err := DecodeJSON(msg, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != tt.code {
+			t.Errorf("%s: code = %q (%s), want %q", tt.name, resp.Code, resp.Error, tt.code)
+		}
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"localhost", "localhost:5000"},
+		{"127.0.0.1", "127.0.0.1:5000"},
+		{"::1", "[::1]:5000"},
+		{"[::1]", "[::1]:5000"},
+		{"", ":5000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			s := &Server{cfg: Config{Addr: tt.addr, Port: 5000}}
+			if got := s.listenAddr(); got != tt.want {
+				t.Errorf("listenAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenWithRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		retries int
+		wantErr bool
+	}{
+		{"no retries", 0, true},
+		{"freed before the second attempt", 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			holder, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := holder.Addr().String()
+			// the first attempt finds the port taken; it is freed well
+			// before the retry delay runs out
+			freed := time.AfterFunc(50*time.Millisecond, func() { holder.Close() })
+			defer freed.Stop()
+			defer holder.Close()
+			ln, err := listenWithRetry(addr, tt.retries, 300*time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer ln.Close()
+			if ln.Addr().String() != addr {
+				t.Errorf("bound %s, want %s", ln.Addr(), addr)
+			}
+		})
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	dir := t.TempDir()
+	cert := writeTestCert(t, dir)
+	_, addr := startServer(t, func(cfg *Config) {
+		cfg.TLSCert = filepath.Join(dir, "cert.pem")
+		cfg.TLSKey = filepath.Join(dir, "key.pem")
+		cfg.HandshakeTimeout = 200 * time.Millisecond
+	})
+
+	t.Run("stalled mid-handshake", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// the start of a ClientHello record, then nothing
+		conn.Write([]byte{0x16, 0x03, 0x01, 0x00})
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		start := time.Now()
+		_, err = io.ReadAll(conn)
+		if isTimeout(err) {
+			t.Fatal("server did not drop the stalled client")
+		}
+		if waited := time.Since(start); waited < 150*time.Millisecond {
+			t.Errorf("dropped after %s, before the handshake timeout", waited)
+		}
+	})
+
+	t.Run("completed handshake outlives the timeout", func(t *testing.T) {
+		pool := x509.NewCertPool()
+		pool.AddCert(cert)
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		time.Sleep(400 * time.Millisecond)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		codec := &jsonCodec{in: newMessageReader(conn, 0, errRequestTooLarge), w: conn, enc: json.NewEncoder(conn)}
+		if err := codec.writeMessage(&Request{RequestID: "1", Method: "ping"}); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := codec.readMessage()
+		if err != nil {
+			t.Fatalf("connection dropped after the handshake: %v", err)
+		}
+		var resp Response
+		if err := DecodeJSON(msg, &resp); err != nil || resp.Status != "OK" {
+			t.Errorf("ping = %s (%v)", msg, err)
+		}
+	})
+}
+
+func TestRequireTimestamp(t *testing.T) {
+	tests := []struct {
+		name      string
+		require   bool
+		timestamp string
+		code      string
+	}{
+		{"required and missing", true, "", ErrBadRequest},
+		{"required and sent", true, time.Now().Format(time.RFC3339), ""},
+		{"optional and missing", false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, func(cfg *Config) { cfg.RequireTimestamp = tt.require })
+			c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+			defer c.Close()
+			resp, _ := c.Do(&Request{RequestID: "1", Method: "ping", Timestamp: tt.timestamp})
+			if resp == nil {
+				t.Fatal("no response")
+			}
+			if resp.Code != tt.code {
+				t.Fatalf("code = %q (%s), want %q", resp.Code, resp.Error, tt.code)
+			}
+			if tt.code != "" && resp.Error != "timestamp required" {
+				t.Errorf("error = %q, want timestamp required", resp.Error)
+			}
+		})
+	}
+}
+
+func TestRequestIDValidation(t *testing.T) {
+	_, addr := startServer(t, nil)
+	tests := []struct {
+		name    string
+		request string
+		errText string // "" when the request should succeed
+	}{
+		{"missing", `{"method":"add","params":{"a":1,"b":2}}`, "missing request_id"},
+		{"empty", `{"request_id":"","method":"add","params":{"a":1,"b":2}}`, "missing request_id"},
+		{"blank", `{"request_id":"   ","method":"add","params":{"a":1,"b":2}}`, "missing request_id"},
+		{"at the limit", `{"request_id":"` + strings.Repeat("x", maxRequestIDLen) + `","method":"add","params":{"a":1,"b":2}}`, ""},
+		{"too long", `{"request_id":"` + strings.Repeat("x", maxRequestIDLen+1) + `","method":"add","params":{"a":1,"b":2}}`, "request_id too long: 129 bytes exceeds 128"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp Response
+			if err := DecodeJSON(rawCall(t, addr, tt.request), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if tt.errText == "" {
+				if resp.Status != "OK" {
+					t.Errorf("got %s (%s), want OK", resp.Status, resp.Error)
+				}
+				return
+			}
+			if resp.Status != "ERROR" || resp.Code != ErrBadRequest || resp.Error != tt.errText {
+				t.Errorf("got %s %q (%s), want bad_request %q", resp.Status, resp.Error, resp.Code, tt.errText)
+			}
+		})
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	const warmup = 300 * time.Millisecond
+	s, addr := startServer(t, func(cfg *Config) { cfg.Warmup = warmup })
+	tests := []struct {
+		name   string
+		after  time.Duration // from startup
+		method string
+		code   string
+	}{
+		{"ping while warming up", 0, "ping", ""},
+		{"work while warming up", 0, "add", ErrNotReady},
+		{"stats while warming up", 0, "stats", ErrNotReady},
+		{"work once ready", warmup, "add", ""},
+		{"ping once ready", warmup, "ping", ""},
+	}
+	started := s.readyAt.Add(-warmup)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			time.Sleep(time.Until(started.Add(tt.after)))
+			resp := call(t, addr, tt.method, map[string]interface{}{"a": 1, "b": 2})
+			if resp.Code != tt.code {
+				t.Fatalf("code = %q (%s), want %q", resp.Code, resp.Error, tt.code)
+			}
+			switch {
+			case tt.method == "ping" && resp.Result != "pong":
+				t.Errorf("ping result = %v, want pong", resp.Result)
+			case tt.code == ErrNotReady && (resp.Error != "server warming up" || resp.RetryAfterMs <= 0 || resp.RetryAfterMs > warmup.Milliseconds()):
+				t.Errorf("got %q with retry_after_ms %d, want server warming up within %s", resp.Error, resp.RetryAfterMs, warmup)
+			}
+		})
+	}
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) { cfg.MaxRequestBytes = 1024 })
+	echo := func(n int) string {
+		return `{"request_id":"e","method":"echo","params":{"s":"` + strings.Repeat("a", n) + `"}}`
+	}
+	tests := []struct {
+		name     string
+		requests []string
+		codes    []string // one per response before the connection closes
+	}{
+		{"under the limit", []string{echo(900)}, []string{""}},
+		// the limit is per request, not per connection
+		{"several under the limit", []string{echo(900), echo(900), echo(900)}, []string{"", "", ""}},
+		{"over the limit", []string{echo(2000)}, []string{ErrRequestTooLarge}},
+		{"far over the limit", []string{echo(8 << 20)}, []string{ErrRequestTooLarge}},
+		{"over after one under", []string{echo(900), echo(2000), echo(10)}, []string{"", ErrRequestTooLarge}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			// the server stops reading part way, so write in the background
+			go io.WriteString(conn, strings.Join(tt.requests, "\n"))
+			in := newMessageReader(conn, 0, errResponseTooLarge)
+			for i, code := range tt.codes {
+				msg, _, err := in.next()
+				if err != nil {
+					t.Fatalf("response %d: %v", i, err)
+				}
+				var resp Response
+				if err := DecodeJSON(msg, &resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Code != code {
+					t.Fatalf("response %d: code = %q (%s), want %q", i, resp.Code, resp.Error, code)
+				}
+			}
+			if tt.codes[len(tt.codes)-1] == ErrRequestTooLarge {
+				if _, _, err := in.next(); err == nil {
+					t.Error("connection still open after request_too_large")
+				}
+			}
+		})
+	}
+}
+
+func TestTrailingData(t *testing.T) {
+	const first, second = `{"request_id":"1","method":"ping"}`, `{"request_id":"2","method":"ping"}`
+	tests := []struct {
+		name    string
+		framing string
+		strict  bool
+		payload string   // one write, or one frame in length framing
+		want    []string // the codes of the responses, in order
+		after   bool     // whether a further request on the connection is answered
+	}{
+		{"json strict", "json", true, first + second, []string{ErrMalformedStream}, false},
+		{"json strict, whitespace only", "json", true, first + " \n", []string{""}, false},
+		{"json lenient", "json", false, first + second, []string{"", ""}, true},
+		{"length frame", "length", false, first + second, []string{ErrMalformedStream}, true},
+		{"length frame, whitespace only", "length", false, first + " \n", []string{""}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, func(cfg *Config) {
+				cfg.Framing = tt.framing
+				cfg.Strict = tt.strict
+			})
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			var codec wireCodec = &jsonCodec{in: newMessageReader(conn, 0, errResponseTooLarge), w: conn, enc: json.NewEncoder(conn)}
+			if tt.framing == "length" {
+				codec = &lengthCodec{r: conn, w: conn, max: 1 << 20}
+				err = writeFrame(conn, []byte(tt.payload))
+			} else {
+				_, err = io.WriteString(conn, tt.payload)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, code := range tt.want {
+				msg, err := codec.readMessage()
+				if err != nil {
+					t.Fatalf("response %d: %v", i, err)
+				}
+				var resp Response
+				if err := DecodeJSON(msg, &resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Code != code {
+					t.Fatalf("response %d: code = %q (%s), want %q", i, resp.Code, resp.Error, code)
+				}
+				if code == ErrMalformedStream && resp.Error != "trailing data after request" {
+					t.Errorf("error = %q, want trailing data after request", resp.Error)
+				}
+			}
+			codec.writeMessage(&Request{RequestID: "3", Method: "ping"})
+			_, err = codec.readMessage()
+			if answered := err == nil; answered != tt.after {
+				t.Errorf("later request answered = %t (%v), want %t", answered, err, tt.after)
+			}
+		})
+	}
+}
+
+func TestMaxStringLen(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) { cfg.MaxStringLen = 16 })
+	tests := []struct {
+		name   string
+		method string
+		params map[string]interface{}
+		code   string
+	}{
+		{"at the limit", "reverse_string", map[string]interface{}{"s": strings.Repeat("a", 16)}, ""},
+		{"over the limit", "reverse_string", map[string]interface{}{"s": strings.Repeat("a", 17)}, ErrBadRequest},
+		{"nested in an object", "echo", map[string]interface{}{"m": map[string]interface{}{"s": strings.Repeat("a", 17)}}, ErrBadRequest},
+		{"nested in an array", "echo", map[string]interface{}{"l": []interface{}{"ok", strings.Repeat("a", 17)}}, ErrBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := call(t, addr, tt.method, tt.params)
+			if resp.Code != tt.code {
+				t.Fatalf("code = %q (%s), want %q", resp.Code, resp.Error, tt.code)
+			}
+			if tt.code != "" && !strings.Contains(resp.Error, "string too long") {
+				t.Errorf("error = %q, want string too long", resp.Error)
+			}
+		})
+	}
+}
+
+func TestMaxParamsKeys(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) { cfg.MaxParamsKeys = 3 })
+	params := func(n int) map[string]interface{} {
+		m := map[string]interface{}{}
+		for i := 0; i < n; i++ {
+			m[fmt.Sprintf("k%d", i)] = i
+		}
+		return m
+	}
+	tests := []struct {
+		name string
+		keys int
+		code string
+	}{
+		{"no params", 0, ""},
+		{"at the limit", 3, ""},
+		{"over the limit", 4, ErrBadRequest},
+		{"far over the limit", 10000, ErrBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := call(t, addr, "echo", params(tt.keys))
+			if resp.Code != tt.code {
+				t.Fatalf("code = %q (%s), want %q", resp.Code, resp.Error, tt.code)
+			}
+			if tt.code != "" && !strings.Contains(resp.Error, "too many params") {
+				t.Errorf("error = %q, want too many params", resp.Error)
+			}
+		})
+	}
+}
+
+func TestMaxClockSkewAction(t *testing.T) {
+	skewed := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	tests := []struct {
+		action string
+		code   string
+		logged bool
+	}{
+		{"reject", ErrBadRequest, false},
+		{"warn", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			_, addr := startServer(t, func(cfg *Config) {
+				cfg.MaxClockSkew = time.Minute
+				cfg.MaxClockSkewAction = tt.action
+			})
+			logs := captureLog(t)
+			c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+			defer c.Close()
+			resp, _ := c.Do(&Request{RequestID: "skewed", Method: "add", Params: map[string]interface{}{"a": 1, "b": 2}, Timestamp: skewed})
+			if resp == nil {
+				t.Fatal("no response")
+			}
+			if resp.Code != tt.code {
+				t.Fatalf("code = %q (%s), want %q", resp.Code, resp.Error, tt.code)
+			}
+			if tt.code == "" && fmt.Sprint(resp.Result) != "3" {
+				t.Errorf("result = %v, want 3", resp.Result)
+			}
+			warned := strings.Contains(logs.String(), "warning: request id=skewed clock skew")
+			if warned != tt.logged {
+				t.Errorf("warning logged = %t, want %t; log:\n%s", warned, tt.logged, logs)
+			}
+		})
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	first := writeTestCert(t, dir)
+	s, addr := startServer(t, func(cfg *Config) {
+		cfg.TLSCert = filepath.Join(dir, "cert.pem")
+		cfg.TLSKey = filepath.Join(dir, "key.pem")
+		cfg.TLSReload = true
+	})
+	served := func() *big.Int {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber
+	}
+	if got := served(); got.Cmp(first.SerialNumber) != 0 {
+		t.Fatalf("served serial %s, want %s", got, first.SerialNumber)
+	}
+
+	second := writeTestCert(t, dir)
+	if err := s.ReloadTLS(); err != nil {
+		t.Fatal(err)
+	}
+	if got := served(); got.Cmp(second.SerialNumber) != 0 {
+		t.Errorf("after reload served serial %s, want %s", got, second.SerialNumber)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "cert.pem"), []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReloadTLS(); err == nil {
+		t.Error("ReloadTLS accepted a broken certificate")
+	}
+	if got := served(); got.Cmp(second.SerialNumber) != 0 {
+		t.Errorf("after a failed reload served serial %s, want the previous %s", got, second.SerialNumber)
+	}
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir)
+	r := &certReloader{certFile: filepath.Join(dir, "cert.pem"), keyFile: filepath.Join(dir, "key.pem")}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	// back-date the loaded pair so the rewrite below always looks newer
+	r.mu.Lock()
+	r.modTime = r.modTime.Add(-time.Hour)
+	r.mu.Unlock()
+	next := writeTestCert(t, dir)
+	go r.watch(20 * time.Millisecond)
+	waitFor(t, func() bool {
+		cert, _ := r.get(nil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		return err == nil && leaf.SerialNumber.Cmp(next.SerialNumber) == 0
+	})
+}
+
+func TestTLSReloadNeedsCert(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TLSReload = true
+	if _, err := NewServer(cfg); err == nil {
+		t.Error("NewServer accepted -tls-reload without -tls-cert and -tls-key")
+	}
+}
+
+func TestGracefulCloseOnIdle(t *testing.T) {
+	tests := []struct {
+		name     string
+		graceful bool
+		raced    bool // send a request right after the idle close
+	}{
+		{"abrupt close", false, false},
+		{"goodbye then close", true, false},
+		{"request racing the goodbye", true, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			_, addr := startServer(t, func(cfg *Config) {
+				cfg.ReadTimeout = 100 * time.Millisecond
+				cfg.GracefulCloseOnIdle = tt.graceful
+			})
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			codec := &jsonCodec{in: newMessageReader(conn, 0, errRequestTooLarge), w: conn, enc: json.NewEncoder(conn)}
+			read := func() (*Response, error) {
+				msg, err := codec.readMessage()
+				if err != nil {
+					return nil, err
+				}
+				var resp Response
+				if err := DecodeJSON(msg, &resp); err != nil {
+					t.Fatal(err)
+				}
+				return &resp, nil
+			}
+			if err := codec.writeMessage(&Request{RequestID: "1", Method: "ping"}); err != nil {
+				t.Fatal(err)
+			}
+			if resp, err := read(); err != nil || resp.Status != "OK" {
+				t.Fatalf("first call: %+v, %v", resp, err)
+			}
+
+			// idle past -read-timeout
+			resp, err := read()
+			if err != nil {
+				t.Fatalf("no frame before the idle close: %v", err)
+			}
+			if !tt.graceful {
+				if resp.Code != ErrReadTimeout {
+					t.Fatalf("got %+v, want a read_timeout error", resp)
+				}
+			} else if resp.Status != "GOODBYE" || !resp.Close || resp.RequestID != "" {
+				t.Fatalf("got %+v, want a goodbye frame", resp)
+			}
+			if tt.raced {
+				if err := codec.writeMessage(&Request{RequestID: "2", Method: "ping"}); err != nil {
+					t.Fatal(err)
+				}
+				resp, err := read()
+				if err != nil || resp.RequestID != "2" || resp.Status != "OK" || !resp.Close {
+					t.Fatalf("in-flight request after the goodbye: %+v, %v", resp, err)
+				}
+			}
+			if _, err := read(); err != io.EOF {
+				t.Errorf("after the idle close: %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestClientAfterGoodbye(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) {
+		cfg.ReadTimeout = 50 * time.Millisecond
+		cfg.GracefulCloseOnIdle = true
+	})
+	c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second, PoolSize: 1})
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := c.Call("ping", nil); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		// the pooled connection gets a goodbye while idle
+		time.Sleep(150 * time.Millisecond)
+	}
+}
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	for _, n := range []int{1, 3} {
+		n := n
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			t.Parallel()
+			_, addr := startServer(t, func(cfg *Config) { cfg.MaxRequestsPerConn = n })
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			codec := &jsonCodec{in: newMessageReader(conn, 0, errRequestTooLarge), w: conn, enc: json.NewEncoder(conn)}
+			for i := 1; i <= n; i++ {
+				if err := codec.writeMessage(&Request{RequestID: fmt.Sprint(i), Method: "ping"}); err != nil {
+					t.Fatal(err)
+				}
+				msg, err := codec.readMessage()
+				if err != nil {
+					t.Fatalf("request %d: %v", i, err)
+				}
+				var resp Response
+				if err := DecodeJSON(msg, &resp); err != nil {
+					t.Fatal(err)
+				}
+				// only the last allowed response carries the hint
+				if resp.Status != "OK" || resp.Close != (i == n) {
+					t.Fatalf("request %d: got %+v, want OK with close=%t", i, resp, i == n)
+				}
+			}
+			// one more goes unanswered: the server has closed
+			codec.writeMessage(&Request{RequestID: "extra", Method: "ping"})
+			if _, err := codec.readMessage(); err == nil {
+				t.Errorf("connection still open after %d requests", n)
+			}
+
+			// a client follows the hint onto fresh connections
+			var dials atomic.Int64
+			c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second, PoolSize: 1, Dial: func(network, addr string) (net.Conn, error) {
+				dials.Add(1)
+				return net.Dial(network, addr)
+			}})
+			defer c.Close()
+			calls := 2*n + 1
+			for i := 0; i < calls; i++ {
+				if _, err := c.Call("ping", nil); err != nil {
+					t.Fatalf("call %d: %v", i, err)
+				}
+			}
+			if want := int64((calls + n - 1) / n); dials.Load() != want {
+				t.Errorf("%d calls took %d connections, want %d", calls, dials.Load(), want)
+			}
+		})
+	}
+}
+
+func TestGracefulCloseOnIdleNeedsReadTimeout(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.GracefulCloseOnIdle = true
+	if _, err := NewServer(cfg); err == nil {
+		t.Error("NewServer accepted -graceful-close-on-idle without -read-timeout")
+	}
+}
+
+func TestOnewayRequests(t *testing.T) {
+	logs := captureLog(t)
+	_, addr := startServer(t, nil)
+
+	t.Run("no response written", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		codec := &jsonCodec{in: newMessageReader(conn, 0, errRequestTooLarge), w: conn, enc: json.NewEncoder(conn)}
+		reqs := []*Request{
+			{RequestID: "ow-1", Method: "echo", Params: map[string]interface{}{"event": "login"}, Oneway: true},
+			{RequestID: "ow-2", Method: "echo", Params: map[string]interface{}{"event": "logout"}, Oneway: true},
+			{RequestID: "after", Method: "ping"},
+		}
+		for _, req := range reqs {
+			if err := codec.writeMessage(req); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the first thing back is the ping's answer
+		msg, err := codec.readMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp Response
+		if err := DecodeJSON(msg, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.RequestID != "after" {
+			t.Errorf("first response is for %q, want the ping", resp.RequestID)
+		}
+		for _, id := range []string{"ow-1", "ow-2"} {
+			if !strings.Contains(logs.String(), "Processed oneway request id="+id+" status=OK") {
+				t.Errorf("oneway request %s not processed", id)
+			}
+		}
+	})
+
+	t.Run("client returns at once", func(t *testing.T) {
+		c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+		defer c.Close()
+		start := time.Now()
+		resp, err := c.Do(&Request{RequestID: "ow-slow", Method: "slow", Params: map[string]interface{}{"sleep": 1}, Oneway: true})
+		if err != nil || resp != nil {
+			t.Fatalf("Do = %+v, %v, want no response", resp, err)
+		}
+		if took := time.Since(start); took > 500*time.Millisecond {
+			t.Errorf("oneway call took %s, waiting on the slow method", took)
+		}
+		waitFor(t, func() bool { return strings.Contains(logs.String(), "Processed oneway request id=ow-slow") })
+	})
+}
+
+func TestQuiesce(t *testing.T) {
+	s, addr := startServer(t, nil)
+	add := map[string]interface{}{"a": 1, "b": 2}
+	// a request already running when the server quiesces still finishes
+	inFlight := make(chan error, 1)
+	go func() {
+		c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+		defer c.Close()
+		_, err := c.Call("slow", map[string]interface{}{"sleep": 1})
+		inFlight <- err
+	}()
+	waitFor(t, func() bool { return s.inFlight.Load() == 1 })
+
+	resp := call(t, addr, "quiesce", nil)
+	if m, _ := resp.Result.(map[string]interface{}); m["quiesced"] != true || fmt.Sprint(m["in_flight"]) != "1" {
+		t.Errorf("quiesce result = %v, want quiesced with 1 in flight", resp.Result)
+	}
+	tests := []struct {
+		name     string
+		toggle   func()
+		method   string
+		rejected bool
+	}{
+		{"new work rejected", nil, "add", true},
+		{"liveness probe answered", nil, "ping", false},
+		{"resumed by unquiesce", func() { call(t, addr, "unquiesce", nil) }, "add", false},
+		{"quiesced by signal toggle", func() { s.SetQuiesced(!s.Quiesced()) }, "add", true},
+		{"resumed by signal toggle", func() { s.SetQuiesced(!s.Quiesced()) }, "add", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.toggle != nil {
+				tt.toggle()
+			}
+			resp := call(t, addr, tt.method, add)
+			if tt.rejected {
+				if resp.Code != ErrUnavailable || resp.Error != "server quiesced" {
+					t.Errorf("%s: %s %q (%s), want server quiesced", tt.method, resp.Status, resp.Error, resp.Code)
+				}
+			} else if resp.Status != "OK" {
+				t.Errorf("%s: %s (%s), want OK", tt.method, resp.Status, resp.Error)
+			}
+		})
+	}
+	if err := <-inFlight; err != nil {
+		t.Errorf("in-flight request failed after quiesce: %v", err)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		request   string
+		wantID    string
+	}{
+		{"inline", nil, `{"request_id":"b1","method":"boom"}`, "b1"},
+		{"under a method timeout", func(c *Config) { c.DefaultMethodTimeout = 5 * time.Second }, `{"request_id":"b1","method":"boom"}`, "b1"},
+		{"on the slow pool", func(c *Config) { c.SlowMethods, c.SlowWorkers = []string{"boom"}, 1 }, `{"request_id":"b1","method":"boom"}`, "b1"},
+		{"with a memory limit", func(c *Config) { c.MaxRequestMemory = 64 << 20 }, `{"request_id":"b1","method":"boom"}`, "b1"},
+		{"in a batch", nil, `[{"request_id":"ok","method":"ping"},{"request_id":"b1","method":"boom"}]`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			cfg := DefaultConfig()
+			cfg.ShutdownTimeout = time.Second
+			if tt.configure != nil {
+				tt.configure(&cfg)
+			}
+			s, err := NewServer(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.handlers["boom"] = func(context.Context, map[string]interface{}) (interface{}, error) {
+				var m map[string]int
+				m["nil map"]++
+				return nil, nil
+			}
+			addr := serve(t, s)
+
+			var resp Response
+			if err := DecodeJSON(rawCall(t, addr, tt.request), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != "ERROR" || resp.Code != ErrInternal || resp.Error != "internal server error" || resp.RequestID != tt.wantID {
+				t.Errorf("got %+v, want an internal error for %q", resp, tt.wantID)
+			}
+			if !strings.Contains(logs.String(), "panic serving request id="+tt.wantID+":") {
+				t.Error("panic not logged with the request id")
+			}
+			// the server is still up for everyone else
+			if resp := call(t, addr, "ping", nil); resp.Status != "OK" {
+				t.Errorf("ping after the panic: %s (%s)", resp.Status, resp.Error)
+			}
+		})
+	}
+}
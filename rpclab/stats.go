@@ -0,0 +1,414 @@
+package rpclab
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// span is the server's part of a traced request, logged as one JSON line.
+// The fields follow OpenTelemetry's span model so the client's and server's
+// span logs can be joined on trace_id.
+type span struct {
+	TraceID      string  `json:"trace_id"`
+	SpanID       string  `json:"span_id"`
+	ParentSpanID string  `json:"parent_span_id,omitempty"`
+	Name         string  `json:"name"`
+	RequestID    string  `json:"request_id"`
+	Start        string  `json:"start"`
+	End          string  `json:"end"`
+	DurationMs   float64 `json:"duration_ms"`
+	Status       string  `json:"status"`
+	Code         string  `json:"code,omitempty"`
+}
+
+// logSpan logs a child span of the caller's covering the dispatch of req,
+// which started at start and ended now
+func logSpan(req *Request, resp *Response, start time.Time) {
+	end := time.Now()
+	b, _ := json.Marshal(span{
+		TraceID:      req.TraceID,
+		SpanID:       newShortID(),
+		ParentSpanID: req.SpanID,
+		Name:         "rpc.server/" + strings.ToLower(req.Method),
+		RequestID:    req.RequestID,
+		Start:        start.Format(time.RFC3339Nano),
+		End:          end.Format(time.RFC3339Nano),
+		DurationMs:   durationMs(end.Sub(start)),
+		Status:       resp.Status,
+		Code:         resp.Code,
+	})
+	log.Printf("span %s", b)
+}
+
+// auditLog appends one JSON object per handled request to a file. Each
+// entry is written straight through so a crash loses nothing already logged.
+type auditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+type auditEntry struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id"`
+	Method     string  `json:"method"`
+	Remote     string  `json:"remote"`
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	Code       string  `json:"code,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f}, nil
+}
+
+func (a *auditLog) record(remote string, req *Request, resp *Response, d time.Duration) {
+	b, err := json.Marshal(auditEntry{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		RequestID:  req.RequestID,
+		Method:     req.Method,
+		Remote:     remote,
+		Status:     resp.Status,
+		Error:      resp.Error,
+		Code:       resp.Code,
+		DurationMs: durationMs(d),
+	})
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return
+	}
+	if _, err := a.f.Write(b); err != nil {
+		log.Printf("log file write error: %v", err)
+	}
+}
+
+// close syncs the file to disk; later records are dropped
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Sync()
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	a.f = nil
+	return err
+}
+
+// idempotencyCache remembers the response computed for each recent request
+// id so a retry is answered without running the method a second time. A retry
+// that arrives while the original is still running waits for its result.
+// Entries expire once unused for ttl; past max entries the least recently
+// used go first.
+type idempotencyCache struct {
+	ttl     time.Duration
+	max     int
+	mu      sync.Mutex
+	order   *list.List // of *idemEntry, most recently used at the front
+	entries map[string]*list.Element
+}
+
+type idemEntry struct {
+	id     string
+	method string
+	used   time.Time
+	done   chan struct{} // closed once resp is set
+	resp   *Response
+}
+
+func newIdempotencyCache(ttl time.Duration, max int) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, max: max, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// do returns the response recorded for req's id, or runs compute and records
+// its result. cached reports whether compute was skipped.
+func (c *idempotencyCache) do(req *Request, compute func() *Response) (resp *Response, cached bool) {
+	c.mu.Lock()
+	c.expire(time.Now())
+	if el, ok := c.entries[req.RequestID]; ok {
+		e := el.Value.(*idemEntry)
+		if !strings.EqualFold(e.method, req.Method) {
+			// same id, different call: not a retry, so don't replay
+			c.mu.Unlock()
+			return compute(), false
+		}
+		e.used = time.Now()
+		c.order.MoveToFront(el)
+		c.mu.Unlock()
+		<-e.done
+		cp := *e.resp
+		return &cp, true
+	}
+	e := &idemEntry{id: req.RequestID, method: req.Method, used: time.Now(), done: make(chan struct{})}
+	c.entries[e.id] = c.order.PushFront(e)
+	for c.max > 0 && c.order.Len() > c.max {
+		c.remove(c.order.Back())
+	}
+	c.mu.Unlock()
+
+	defer func() {
+		if e.resp == nil {
+			// compute panicked; give waiters an answer and let the next retry run again
+			e.resp = &Response{RequestID: e.id, Status: "ERROR", Error: "internal server error", Code: ErrInternal}
+			c.forget(e)
+		} else if e.resp.Code == ErrUnavailable || e.resp.Code == ErrNotReady {
+			// capacity rejections are transient, so retries must really retry
+			c.forget(e)
+		}
+		close(e.done)
+	}()
+	e.resp = compute()
+	return e.resp, false
+}
+
+// forget drops e unless it has already been replaced or evicted
+func (c *idempotencyCache) forget(e *idemEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.id]; ok && el.Value.(*idemEntry) == e {
+		c.remove(el)
+	}
+}
+
+// expire drops entries unused for longer than ttl. The list is in order of
+// use, so it stops at the first live entry. Callers hold mu.
+func (c *idempotencyCache) expire(now time.Time) {
+	for el := c.order.Back(); el != nil && now.Sub(el.Value.(*idemEntry).used) > c.ttl; el = c.order.Back() {
+		c.remove(el)
+	}
+}
+
+// remove unlinks el; callers hold mu
+func (c *idempotencyCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*idemEntry).id)
+}
+
+// retryTracker counts sightings of each request id within a sliding window
+// so retries of the same logical operation show up as attempt=N
+type retryTracker struct {
+	mu        sync.Mutex
+	window    time.Duration
+	clock     Clock
+	seen      map[string]*seenID
+	lastPrune time.Time
+}
+
+type seenID struct {
+	count int
+	last  time.Time
+}
+
+// observe records a sighting of id and returns how many times it has been
+// seen within the window, including this one
+func (t *retryTracker) observe(id string) int {
+	if id == "" || t.window <= 0 {
+		return 1
+	}
+	now := t.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.lastPrune) > t.window {
+		for k, e := range t.seen {
+			if now.Sub(e.last) > t.window {
+				delete(t.seen, k)
+			}
+		}
+		t.lastPrune = now
+	}
+	e, ok := t.seen[id]
+	if !ok || now.Sub(e.last) > t.window {
+		e = &seenID{}
+		t.seen[id] = e
+	}
+	e.count++
+	e.last = now
+	return e.count
+}
+
+// slowRequest is one entry in the slowest-requests list
+type slowRequest struct {
+	RequestID  string  `json:"request_id"`
+	Method     string  `json:"method"`
+	DurationMs float64 `json:"duration_ms"`
+	Timestamp  string  `json:"timestamp"`
+	ParamsHash string  `json:"params_hash"`
+}
+
+// serverStats counts handled requests per method along with total errors,
+// client retries and disconnects, and a histogram of processing time
+type serverStats struct {
+	mu          sync.Mutex
+	start       time.Time
+	counts      map[string]int64
+	errors      int64
+	retries     int64   // requests repeating an id seen within the retry window
+	disconnects int64   // responses lost because the client had gone away
+	buckets     []int64 // per durationBuckets bound, plus a final +Inf bucket
+	total       time.Duration
+}
+
+// upper bounds in seconds of the request duration histogram
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func newServerStats() *serverStats {
+	return &serverStats{start: time.Now(), counts: map[string]int64{}, buckets: make([]int64, len(durationBuckets)+1)}
+}
+
+// record counts one processed request; methods not in the catalog are
+// lumped together as "unknown" so arbitrary names can't grow the map
+func (s *serverStats) record(method string, r *Response, d time.Duration) {
+	name := strings.ToLower(method)
+	if !KnownMethod(name) {
+		name = "unknown"
+	}
+	i := sort.SearchFloat64s(durationBuckets, d.Seconds())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[name]++
+	if r.Status != "OK" {
+		s.errors++
+	}
+	s.buckets[i]++
+	s.total += d
+}
+
+// retried counts a request that repeated an id seen within the retry window
+func (s *serverStats) retried() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries++
+}
+
+// disconnected counts a response lost because the client hung up first
+func (s *serverStats) disconnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnects++
+}
+
+// writePrometheus writes the counters in the Prometheus text format
+func (s *serverStats) writePrometheus(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	methods := make([]string, 0, len(s.counts))
+	var n int64
+	for m, c := range s.counts {
+		methods = append(methods, m)
+		n += c
+	}
+	sort.Strings(methods)
+	fmt.Fprintln(w, "# HELP rpc_requests_total Requests processed, by method.")
+	fmt.Fprintln(w, "# TYPE rpc_requests_total counter")
+	for _, m := range methods {
+		fmt.Fprintf(w, "rpc_requests_total{method=%q} %d\n", m, s.counts[m])
+	}
+	fmt.Fprintln(w, "# HELP rpc_errors_total Requests answered with an error.")
+	fmt.Fprintln(w, "# TYPE rpc_errors_total counter")
+	fmt.Fprintf(w, "rpc_errors_total %d\n", s.errors)
+	fmt.Fprintln(w, "# HELP rpc_retry_count_total Requests that repeated a request_id seen within the retry window.")
+	fmt.Fprintln(w, "# TYPE rpc_retry_count_total counter")
+	fmt.Fprintf(w, "rpc_retry_count_total %d\n", s.retries)
+	fmt.Fprintln(w, "# HELP rpc_client_disconnects_total Responses not delivered because the client had disconnected.")
+	fmt.Fprintln(w, "# TYPE rpc_client_disconnects_total counter")
+	fmt.Fprintf(w, "rpc_client_disconnects_total %d\n", s.disconnects)
+	fmt.Fprintln(w, "# HELP rpc_request_duration_seconds Time spent processing requests.")
+	fmt.Fprintln(w, "# TYPE rpc_request_duration_seconds histogram")
+	var cum int64
+	for i, le := range durationBuckets {
+		cum += s.buckets[i]
+		fmt.Fprintf(w, "rpc_request_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), cum)
+	}
+	fmt.Fprintf(w, "rpc_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", n)
+	fmt.Fprintf(w, "rpc_request_duration_seconds_sum %g\n", s.total.Seconds())
+	fmt.Fprintf(w, "rpc_request_duration_seconds_count %d\n", n)
+}
+
+// serveMetrics exposes stats at /metrics on ln
+func (s *Server) serveMetrics(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.stats.writePrometheus(w)
+	})
+	if err := http.Serve(ln, mux); err != nil {
+		log.Printf("metrics server: %v", err)
+	}
+}
+
+func (s *serverStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]interface{}, len(s.counts)+4)
+	for m, n := range s.counts {
+		out[m] = n
+	}
+	out["errors"] = s.errors
+	out["retry_count"] = s.retries
+	out["client_disconnects"] = s.disconnects
+	out["uptime_seconds"] = int64(time.Since(s.start).Seconds())
+	return out
+}
+
+// slowestTracker keeps the n slowest requests seen, slowest first
+type slowestTracker struct {
+	mu      sync.Mutex
+	n       int
+	clock   Clock
+	entries []slowRequest
+}
+
+func (t *slowestTracker) record(req *Request, d time.Duration) {
+	if t.n <= 0 {
+		return
+	}
+	ms := float64(d.Microseconds()) / 1000
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.entries) == t.n && ms <= t.entries[len(t.entries)-1].DurationMs {
+		return
+	}
+	b, _ := json.Marshal(req.Params)
+	sum := sha256.Sum256(b)
+	t.entries = append(t.entries, slowRequest{
+		RequestID:  req.RequestID,
+		Method:     req.Method,
+		DurationMs: ms,
+		Timestamp:  t.clock.Now().Format(time.RFC3339),
+		ParamsHash: hex.EncodeToString(sum[:8]),
+	})
+	sort.SliceStable(t.entries, func(i, j int) bool { return t.entries[i].DurationMs > t.entries[j].DurationMs })
+	if len(t.entries) > t.n {
+		t.entries = t.entries[:t.n]
+	}
+}
+
+func (t *slowestTracker) snapshot() []slowRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]slowRequest{}, t.entries...)
+}
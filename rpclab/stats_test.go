@@ -0,0 +1,155 @@
+package rpclab
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stat reads one counter from the stats method
+func stat(t *testing.T, addr, name string) string {
+	t.Helper()
+	resp := call(t, addr, "stats", nil)
+	m, ok := resp.Result.(map[string]interface{})
+	if !ok {
+		t.Fatalf("stats result = %#v", resp.Result)
+	}
+	return fmt.Sprint(m[name])
+}
+
+func TestRetriesCounted(t *testing.T) {
+	logs := captureLog(t)
+	s, addr := startServer(t, nil)
+	c := NewClient(addr, ClientConfig{Timeout: 5 * time.Second})
+	req := &Request{RequestID: "same-id", Method: "ping"}
+	for i := 0; i < 3; i++ {
+		if _, err := c.Do(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, attempt := range []string{"attempt=1", "attempt=2", "attempt=3"} {
+		if !strings.Contains(logs.String(), "id=same-id "+attempt+" ") {
+			t.Errorf("no %s logged for same-id", attempt)
+		}
+	}
+	if got := stat(t, addr, "retry_count"); got != "2" {
+		t.Errorf("retry_count = %s, want 2", got)
+	}
+	var metrics bytes.Buffer
+	s.stats.writePrometheus(&metrics)
+	if !strings.Contains(metrics.String(), "\nrpc_retry_count_total 2\n") {
+		t.Errorf("metrics missing rpc_retry_count_total 2:\n%s", metrics.String())
+	}
+}
+
+func TestClientDisconnectCounted(t *testing.T) {
+	logs := captureLog(t)
+	s, addr := startServer(t, func(cfg *Config) { cfg.Debug = true })
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte(`{"request_id":"gone","method":"slow","params":{"sleep":1}}`)); err != nil {
+		t.Fatal(err)
+	}
+	// wait until the request is being handled, then hang up with a reset so
+	// the server's response write fails
+	waitFor(t, func() bool { return strings.Contains(logs.String(), "id=gone") })
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+
+	waitFor(t, func() bool { return stat(t, addr, "client_disconnects") == "1" })
+	out := logs.String()
+	if !strings.Contains(out, "DEBUG [") || !strings.Contains(out, "client disconnected before response id=gone") {
+		t.Errorf("disconnect not logged at debug level:\n%s", out)
+	}
+	if strings.Contains(out, "encode error") {
+		t.Errorf("disconnect logged as an encode error:\n%s", out)
+	}
+	var metrics bytes.Buffer
+	s.stats.writePrometheus(&metrics)
+	if !strings.Contains(metrics.String(), "\nrpc_client_disconnects_total 1\n") {
+		t.Errorf("metrics missing rpc_client_disconnects_total 1:\n%s", metrics.String())
+	}
+}
+
+func TestUnknownMethodsShareALabel(t *testing.T) {
+	s, addr := startServer(t, nil)
+	tests := []struct {
+		method string
+		label  string
+	}{
+		{"add", "add"},
+		{"ADD", "add"},
+		{"no_such_method_" + NewRequestID(), "unknown"},
+		{"another_" + NewRequestID(), "unknown"},
+	}
+	for _, tt := range tests {
+		call(t, addr, tt.method, map[string]interface{}{"a": 1, "b": 2})
+	}
+	var metrics bytes.Buffer
+	s.stats.writePrometheus(&metrics)
+	for _, want := range []string{`rpc_requests_total{method="add"} 2`, `rpc_requests_total{method="unknown"} 2`} {
+		if !strings.Contains(metrics.String(), want+"\n") {
+			t.Errorf("metrics missing %s:\n%s", want, metrics.String())
+		}
+	}
+	for _, tt := range tests {
+		if tt.label == "unknown" && strings.Contains(metrics.String(), tt.method) {
+			t.Errorf("metrics has a label for %s", tt.method)
+		}
+	}
+}
+
+func TestSlowestTracker(t *testing.T) {
+	tests := []struct {
+		name  string
+		n     int
+		durMs []int
+		want  []string // request ids, slowest first
+	}{
+		{"fewer than n", 3, []int{5, 9}, []string{"r1", "r0"}},
+		{"keeps the top n", 3, []int{5, 1, 9, 3, 7}, []string{"r2", "r4", "r0"}},
+		{"ties keep the earlier", 2, []int{4, 4, 4}, []string{"r0", "r1"}},
+		{"off", 0, []int{5}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &slowestTracker{n: tt.n, clock: systemClock{}}
+			for i, ms := range tt.durMs {
+				tr.record(&Request{RequestID: fmt.Sprintf("r%d", i), Method: "slow"}, time.Duration(ms)*time.Millisecond)
+			}
+			var got []string
+			for _, e := range tr.snapshot() {
+				got = append(got, e.RequestID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("slowest = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlowestMethod(t *testing.T) {
+	_, addr := startServer(t, func(cfg *Config) { cfg.LogSlowestRequests = 2 })
+	for _, sleep := range []int{0, 1, 0} {
+		call(t, addr, "slow", map[string]interface{}{"sleep": sleep})
+	}
+	resp := call(t, addr, "slowest", nil)
+	entries, ok := resp.Result.([]interface{})
+	if !ok || len(entries) != 2 {
+		t.Fatalf("slowest result = %#v, want 2 entries", resp.Result)
+	}
+	top, _ := entries[0].(map[string]interface{})
+	ms, _ := top["duration_ms"].(json.Number).Float64()
+	if top["method"] != "slow" || ms < 1000 {
+		t.Errorf("top entry = %v, want the 1s slow call", top)
+	}
+	if top["params_hash"] == "" || top["timestamp"] == "" {
+		t.Errorf("top entry = %v, want a params hash and timestamp", top)
+	}
+}